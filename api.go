@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// whereabouts is the page as served by the JSON API. It is versioned with
+// the route, so fields are only ever added to it.
+type whereabouts struct {
+	LastFetch   time.Time  `json:"lastFetch"`
+	Stale       bool       `json:"stale"`
+	Current     *apiEvent  `json:"current"`
+	Concurrent  []apiEvent `json:"concurrent"`
+	Past        []apiEvent `json:"past"`
+	Future      []apiEvent `json:"future"`
+	Unavailable int        `json:"unavailableSources,omitempty"`
+
+	// Nearby is when the person comes to a watched place.
+	Nearby []colocation `json:"nearby,omitempty"`
+}
+
+type apiEvent struct {
+	Summary     string       `json:"summary"`
+	From        time.Time    `json:"from"`
+	To          time.Time    `json:"to"`
+	AllDay      bool         `json:"allDay"`
+	Description []string     `json:"description,omitempty"`
+	Location    *apiLocation `json:"location,omitempty"`
+}
+
+type apiLocation struct {
+	Title     string   `json:"title"`
+	Latitude  *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
+	Radius    float64  `json:"radius,omitempty"`
+}
+
+func newAPIEvent(pe pageEvent) apiEvent {
+	ret := apiEvent{
+		Summary:     pe.Summary,
+		From:        pe.From,
+		To:          pe.To,
+		AllDay:      pe.AllDay,
+		Description: pe.Description,
+	}
+
+	if loc := pe.Location; loc != nil {
+		ret.Location = &apiLocation{
+			Title:     loc.Title,
+			Latitude:  parseCoordinate(loc.Latitude),
+			Longitude: parseCoordinate(loc.Longitude),
+			Radius:    loc.Radius,
+		}
+	}
+
+	return ret
+}
+
+func parseCoordinate(str string) *float64 {
+	f, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return nil
+	}
+
+	return &f
+}
+
+func newAPIEvents(es pageEvents) []apiEvent {
+	ret := make([]apiEvent, 0, len(es))
+	for _, pe := range es {
+		ret = append(ret, newAPIEvent(pe))
+	}
+
+	return ret
+}
+
+// newWhereabouts returns p, the page of s as restricted for the viewer,
+// for the API.
+func newWhereabouts(s *snapshot, p *page) whereabouts {
+	fresh := s.freshness()
+
+	ret := whereabouts{
+		LastFetch:   fresh.lastFetch,
+		Stale:       fresh.stale,
+		Concurrent:  newAPIEvents(p.Concurrent),
+		Past:        newAPIEvents(p.Past),
+		Future:      newAPIEvents(p.Future),
+		Unavailable: fresh.unavailable,
+	}
+
+	if p.Current != nil {
+		cur := newAPIEvent(*p.Current)
+		ret.Current = &cur
+	}
+
+	return ret
+}
+
+// whereaboutsHandler serves the page as JSON, with the same access rules
+// as the HTML page.
+func (h *hvor) whereaboutsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v, ok := h.authorise(w, r, accessToken)
+		if !ok {
+			return
+		}
+
+		s := h.snap.Load()
+		ret := newWhereabouts(s, s.calPage.restrict(v.scope))
+		ret.Nearby = h.nearby(v)
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(ret)
+	})
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const auditRecent = 50
+
+var viewsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "hvor_views_total",
+	Help: "Authorised requests by route. Who made them is only in the audit log.",
+}, []string{"route"})
+
+// auditEntry is a single authorised view, one JSON object per line in the
+// audit log.
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	Viewer    string    `json:"viewer"`
+	Route     string    `json:"route"`
+	UserAgent string    `json:"userAgent,omitempty"`
+}
+
+// auditLog is an append-only log of views. When it grows past maxSize it
+// is rotated to path.1, path.1 to path.2 and so on, keeping keep old files.
+type auditLog struct {
+	path    string
+	maxSize int64
+	keep    int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func openAuditLog(path string, maxSize int64, keep int) (*auditLog, error) {
+	l := &auditLog{path: path, maxSize: maxSize, keep: keep}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *auditLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	l.f = f
+	l.size = info.Size()
+
+	return nil
+}
+
+// rotatedPath returns the path of the i'th old file, or of the current
+// one for 0.
+func (l *auditLog) rotatedPath(i int) string {
+	if i == 0 {
+		return l.path
+	}
+
+	return fmt.Sprintf("%s.%d", l.path, i)
+}
+
+func (l *auditLog) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return fmt.Errorf("failed to close audit log: %w", err)
+	}
+
+	if l.keep == 0 {
+		if err := os.Remove(l.path); err != nil {
+			return fmt.Errorf("failed to rotate audit log: %w", err)
+		}
+	}
+
+	for i := l.keep; i > 0; i-- {
+		err := os.Rename(l.rotatedPath(i-1), l.rotatedPath(i))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to rotate audit log: %w", err)
+		}
+	}
+
+	return l.open()
+}
+
+func (l *auditLog) write(e auditEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit entry: %w", err)
+	}
+
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.f.Write(line)
+	l.size += int64(n)
+
+	if err != nil {
+		return fmt.Errorf("failed to write audit entry: %w", err)
+	}
+
+	return nil
+}
+
+// entries reads the kept views, oldest first. Lines that cannot be decoded
+// are skipped.
+func (l *auditLog) entries() ([]auditEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var ret []auditEntry
+
+	for i := l.keep; i >= 0; i-- {
+		f, err := os.Open(l.rotatedPath(i))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read audit log: %w", err)
+		}
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var e auditEntry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err == nil {
+				ret = append(ret, e)
+			}
+		}
+
+		err = scanner.Err()
+		_ = f.Close()
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read audit log: %w", err)
+		}
+	}
+
+	return ret, nil
+}
+
+// viewerSummary is what the audit view shows for each viewer.
+type viewerSummary struct {
+	Viewer    string
+	Views     int
+	First     time.Time
+	Last      time.Time
+	LastRoute string
+	UserAgent string
+}
+
+// summariseViews groups entries by viewer, most recently seen first.
+func summariseViews(entries []auditEntry) []viewerSummary {
+	byViewer := make(map[string]*viewerSummary)
+
+	for _, e := range entries {
+		vs, ok := byViewer[e.Viewer]
+		if !ok {
+			vs = &viewerSummary{Viewer: e.Viewer, First: e.Time}
+			byViewer[e.Viewer] = vs
+		}
+
+		vs.Views++
+
+		if !e.Time.Before(vs.Last) {
+			vs.Last = e.Time
+			vs.LastRoute = e.Route
+			vs.UserAgent = e.UserAgent
+		}
+	}
+
+	ret := make([]viewerSummary, 0, len(byViewer))
+	for _, vs := range byViewer {
+		ret = append(ret, *vs)
+	}
+
+	slices.SortFunc(ret, func(a, b viewerSummary) int {
+		return b.Last.Compare(a.Last)
+	})
+
+	return ret
+}
+
+// recordView counts an authorised request and writes it to the audit log.
+func (h *hvor) recordView(r *http.Request, v viewer) {
+	route := cmp.Or(r.Pattern, r.URL.Path)
+
+	viewsTotal.WithLabelValues(route).Inc()
+
+	if h.audit == nil {
+		return
+	}
+
+	err := h.audit.write(auditEntry{
+		Time:      time.Now(),
+		Viewer:    v.label,
+		Route:     route,
+		UserAgent: r.UserAgent(),
+	})
+	if err != nil {
+		h.logf("failed to record view: %s", err)
+	}
+}
+
+// auditHandler shows who looked at hvor and when. Like refreshing, it
+// needs the full scope, so links shared with others cannot see who else
+// looks.
+func (h *hvor) auditHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !h.authoriseFull(w, r) {
+			return
+		}
+
+		if h.audit == nil {
+			http.Error(w, "no audit log configured", http.StatusNotFound)
+
+			return
+		}
+
+		entries, err := h.audit.entries()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+
+			return
+		}
+
+		recent := entries[max(len(entries)-auditRecent, 0):]
+		slices.Reverse(recent)
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(auditPage(summariseViews(entries), recent).Render()))
+	})
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+const (
+	caldavTimeFormat = "20060102T150405Z"
+
+	propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:" xmlns:cs="http://calendarserver.org/ns/">
+  <d:prop>
+    <d:resourcetype/>
+    <cs:getctag/>
+    <d:sync-token/>
+  </d:prop>
+</d:propfind>`
+
+	calendarQueryBody = `<?xml version="1.0" encoding="utf-8"?>
+<c:calendar-query xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav">
+  <d:prop>
+    <d:getetag/>
+    <c:calendar-data/>
+  </d:prop>
+  <c:filter>
+    <c:comp-filter name="VCALENDAR">
+      <c:comp-filter name="VEVENT">
+        <c:time-range start="%s" end="%s"/>
+      </c:comp-filter>
+    </c:comp-filter>
+  </c:filter>
+</c:calendar-query>`
+)
+
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"DAV: multistatus"`
+	Responses []davResponse `xml:"DAV: response"`
+}
+
+type davResponse struct {
+	Href      string        `xml:"DAV: href"`
+	Propstats []davPropstat `xml:"DAV: propstat"`
+}
+
+type davPropstat struct {
+	Status string  `xml:"DAV: status"`
+	Prop   davProp `xml:"DAV: prop"`
+}
+
+type davProp struct {
+	ResourceType struct {
+		Calendar *struct{} `xml:"urn:ietf:params:xml:ns:caldav calendar"`
+	} `xml:"DAV: resourcetype"`
+	CTag         string `xml:"http://calendarserver.org/ns/ getctag"`
+	SyncToken    string `xml:"DAV: sync-token"`
+	CalendarData string `xml:"urn:ietf:params:xml:ns:caldav calendar-data"`
+}
+
+// props returns the properties the server reported successfully.
+func (r davResponse) props() []davProp {
+	var ret []davProp
+
+	for _, ps := range r.Propstats {
+		if ps.Status == "" || strings.Contains(ps.Status, " 200 ") {
+			ret = append(ret, ps.Prop)
+		}
+	}
+
+	return ret
+}
+
+// caldavAuth holds the credentials used for CalDAV sources.
+type caldavAuth struct {
+	username string
+	password string
+	token    string
+}
+
+// loadCalDAVAuth reads CalDAV credentials from path, which holds either
+// "username:password" for basic auth or "Bearer <token>". An empty path
+// means no authentication.
+func loadCalDAVAuth(path string) (caldavAuth, error) {
+	if path == "" {
+		return caldavAuth{}, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return caldavAuth{}, fmt.Errorf("failed to read caldav credentials: %w", err)
+	}
+
+	creds := strings.TrimSpace(string(content))
+
+	if token, ok := strings.CutPrefix(creds, "Bearer "); ok {
+		return caldavAuth{token: strings.TrimSpace(token)}, nil
+	}
+
+	username, password, ok := strings.Cut(creds, ":")
+	if !ok {
+		return caldavAuth{}, fmt.Errorf("caldav credentials must be \"username:password\" or \"Bearer <token>\"")
+	}
+
+	return caldavAuth{username: username, password: password}, nil
+}
+
+func (a caldavAuth) apply(req *http.Request) {
+	switch {
+	case a.token != "":
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	case a.username != "":
+		req.Header.Set(
+			"Authorization",
+			"Basic "+base64.StdEncoding.EncodeToString([]byte(a.username+":"+a.password)),
+		)
+	}
+}
+
+func davRequest(method string, target *url.URL, depth, body string, auth caldavAuth) (*davMultistatus, error) {
+	req, err := http.NewRequest(method, target.String(), strings.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s request: %w", method, err)
+	}
+
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	req.Header.Set("Depth", depth)
+	auth.apply(req)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to %s calendar: %w", method, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, statusError{op: "caldav " + method, code: resp.StatusCode}
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s response: %w", method, err)
+	}
+
+	var ms davMultistatus
+	if err := xml.Unmarshal(data, &ms); err != nil {
+		return nil, fmt.Errorf("failed to decode %s response: %w", method, err)
+	}
+
+	return &ms, nil
+}
+
+// davCalendar is a calendar collection found on a CalDAV server.
+type davCalendar struct {
+	url *url.URL
+	tag string
+}
+
+// caldavCalendars finds the calendars to read: the collection at u itself,
+// or every calendar directly inside it when u is a calendar home.
+func caldavCalendars(u *url.URL, auth caldavAuth) ([]davCalendar, error) {
+	for _, depth := range []string{"0", "1"} {
+		ms, err := davRequest("PROPFIND", u, depth, propfindBody, auth)
+		if err != nil {
+			return nil, err
+		}
+
+		var ret []davCalendar
+
+		for _, resp := range ms.Responses {
+			for _, prop := range resp.props() {
+				if prop.ResourceType.Calendar == nil {
+					continue
+				}
+
+				href, err := url.Parse(resp.Href)
+				if err != nil {
+					return nil, fmt.Errorf("invalid calendar href %q: %w", resp.Href, err)
+				}
+
+				ret = append(ret, davCalendar{
+					url: u.ResolveReference(href),
+					tag: cmp.Or(prop.CTag, prop.SyncToken),
+				})
+			}
+		}
+
+		if len(ret) > 0 {
+			return ret, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no calendars found")
+}
+
+// calendarQuery fetches the events of a calendar overlapping [start, end).
+func calendarQuery(cal davCalendar, auth caldavAuth, start, end time.Time) ([]*ics.Calendar, error) {
+	body := fmt.Sprintf(
+		calendarQueryBody,
+		start.UTC().Format(caldavTimeFormat),
+		end.UTC().Format(caldavTimeFormat),
+	)
+
+	ms, err := davRequest("REPORT", cal.url, "1", body, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []*ics.Calendar
+
+	for _, resp := range ms.Responses {
+		for _, prop := range resp.props() {
+			if strings.TrimSpace(prop.CalendarData) == "" {
+				continue
+			}
+
+			parsed, err := ics.ParseCalendar(strings.NewReader(prop.CalendarData))
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse %s: %w", resp.Href, err)
+			}
+
+			ret = append(ret, parsed)
+		}
+	}
+
+	return ret, nil
+}
+
+// fetchCalDAV reads the events within the displayed window from a CalDAV
+// calendar, or from every calendar in a calendar home, and returns them
+// as a single iCal calendar.
+//
+// The validators carry the collection tags (getctag or sync-token) and
+// the window, so an unchanged calendar is not queried again the same day.
+// The credentials are read from the path credentials on every fetch.
+func fetchCalDAV(u *url.URL, v validators, w window, credentials string) ([]byte, validators, error) {
+	auth, err := loadCalDAVAuth(credentials)
+	if err != nil {
+		return nil, v, err
+	}
+
+	start, end := w.bounds(time.Now())
+
+	cals, err := caldavCalendars(u, auth)
+	if err != nil {
+		return nil, v, err
+	}
+
+	tags := []string{start.Format(icalDateFormat)}
+
+	for _, cal := range cals {
+		if cal.tag == "" {
+			tags = nil
+
+			break
+		}
+
+		tags = append(tags, cal.url.Path+"="+cal.tag)
+	}
+
+	etag := strings.Join(tags, ",")
+	if etag != "" && etag == v.etag {
+		return nil, v, errNotModified
+	}
+
+	var parsed []*ics.Calendar
+
+	for _, cal := range cals {
+		ps, err := calendarQuery(cal, auth, start, end)
+		if err != nil {
+			return nil, v, err
+		}
+
+		parsed = append(parsed, ps...)
+	}
+
+	return []byte(mergeCalendars(parsed).Serialize()), validators{etag: etag}, nil
+}
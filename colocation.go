@@ -0,0 +1,320 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultColocationDistance is how close, in km, two places have to
+	// be to count as the same place.
+	defaultColocationDistance = 50
+
+	// colocationPoll is how often co-locations are checked for new ones
+	// to tell the webhooks about.
+	colocationPoll = time.Minute
+)
+
+// colocationConfig configures the detection of people being in the same
+// place at the same time, and of people coming to watched places:
+//
+//	"colocation": {
+//	  "distance": 50,
+//	  "watch": [{"name": "Oslo office", "latitude": 59.91, "longitude": 10.75}],
+//	},
+//
+// New co-locations are told to the webhooks as "colocation" events.
+type colocationConfig struct {
+	// Distance is how close, in km, the edges of places have to be.
+	Distance float64         `json:"distance"`
+	Watch    []watchLocation `json:"watch"`
+}
+
+type watchLocation struct {
+	Name      string  `json:"name"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+func (cc colocationConfig) distance() float64 {
+	return cmp.Or(cc.Distance, defaultColocationDistance)
+}
+
+func (cc colocationConfig) validate() []error {
+	var errs []error
+
+	if cc.Distance < 0 {
+		errs = append(errs, fmt.Errorf("colocation.distance: must not be negative"))
+	}
+
+	for i, wl := range cc.Watch {
+		if wl.Name == "" {
+			errs = append(errs, fmt.Errorf("colocation.watch[%d]: no name", i))
+		}
+
+		if math.Abs(wl.Latitude) > 90 || math.Abs(wl.Longitude) > 180 {
+			errs = append(errs, fmt.Errorf("colocation.watch[%d]: coordinates out of range", i))
+		}
+	}
+
+	return errs
+}
+
+// colocation is people being close to each other, or to a watched place,
+// at the same time.
+type colocation struct {
+	// People are the ids of who is there.
+	People []string  `json:"people,omitempty"`
+	Watch  string    `json:"watch,omitempty"`
+	Where  string    `json:"where"`
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+
+	// Distance is how far apart, in km, the places are.
+	Distance float64 `json:"distanceKm"`
+}
+
+func (c colocation) key() string {
+	return fmt.Sprintf("%s|%s|%s|%s", strings.Join(c.People, ","), c.Watch, c.From.Format(icalDateFormat), c.To.Format(icalDateFormat))
+}
+
+// whereabout is an event someone is, or will be, somewhere at, within
+// radius km of lat, lon.
+type whereabout struct {
+	event    pageEvent
+	lat, lon float64
+	radius   float64
+}
+
+// locatedEvents returns the located events of p that have not ended.
+func locatedEvents(p *page) []whereabout {
+	var es pageEvents
+	if p.Current != nil {
+		es = append(es, *p.Current)
+	}
+
+	es = append(es, p.Concurrent...)
+	es = append(es, p.Future...)
+
+	var ret []whereabout
+
+	for _, pe := range es {
+		if pe.Location == nil {
+			continue
+		}
+
+		lat, lon := parseCoordinate(pe.Location.Latitude), parseCoordinate(pe.Location.Longitude)
+		if lat == nil || lon == nil {
+			continue
+		}
+
+		ret = append(ret, whereabout{event: pe, lat: *lat, lon: *lon, radius: pe.Location.Radius / 1000})
+	}
+
+	return ret
+}
+
+// findColocations returns, by time, when people are within maxDistance km
+// of each other, or of a watched place, in overlapping date ranges. The
+// radii of the places count towards the distance, so two cities given as
+// large areas match at the edges.
+func findColocations(people map[string]*page, watch []watchLocation, maxDistance float64) []colocation {
+	ids := slices.Sorted(maps.Keys(people))
+
+	located := make(map[string][]whereabout, len(ids))
+	for _, id := range ids {
+		located[id] = locatedEvents(people[id])
+	}
+
+	var ret []colocation
+
+	seen := make(map[string]bool)
+	add := func(c colocation) {
+		if k := c.key(); !seen[k] {
+			seen[k] = true
+			ret = append(ret, c)
+		}
+	}
+
+	for i, a := range ids {
+		for _, wa := range located[a] {
+			for _, wl := range watch {
+				if d := haversine(wa.lat, wa.lon, wl.Latitude, wl.Longitude); d <= maxDistance+wa.radius {
+					add(colocation{
+						People:   []string{a},
+						Watch:    wl.Name,
+						Where:    wa.event.Location.Title,
+						From:     wa.event.From,
+						To:       wa.event.To,
+						Distance: math.Round(d),
+					})
+				}
+			}
+
+			for _, b := range ids[i+1:] {
+				for _, wb := range located[b] {
+					from, to := later(wa.event.From, wb.event.From), earlier(wa.event.To, wb.event.To)
+					if !from.Before(to) {
+						continue
+					}
+
+					if d := haversine(wa.lat, wa.lon, wb.lat, wb.lon); d <= maxDistance+wa.radius+wb.radius {
+						add(colocation{
+							People:   []string{a, b},
+							Where:    wa.event.Location.Title,
+							From:     from,
+							To:       to,
+							Distance: math.Round(d),
+						})
+					}
+				}
+			}
+		}
+	}
+
+	slices.SortStableFunc(ret, func(x, y colocation) int {
+		return x.From.Compare(y.From)
+	})
+
+	return ret
+}
+
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+
+	return b
+}
+
+func earlier(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+
+	return b
+}
+
+// haversine returns the distance in km between two coordinates.
+func haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+
+	x := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+
+	return 2 * earthRadius / 1000 * math.Asin(math.Sqrt(x))
+}
+
+// colocations returns the co-locations of people as seen by v.
+func colocations(people []*hvor, cc colocationConfig, v viewer) []colocation {
+	pages := make(map[string]*page, len(people))
+
+	for _, h := range people {
+		if s := h.snap.Load(); s != nil {
+			pages[h.config().person.ID] = s.calPage.restrict(v.scope)
+		}
+	}
+
+	return findColocations(pages, cc.Watch, cc.distance())
+}
+
+// nearby returns when the person of h comes to a watched place, as seen by
+// v.
+func (h *hvor) nearby(v viewer) []colocation {
+	ret := colocations([]*hvor{h}, h.config().Colocation, v)
+
+	for i := range ret {
+		ret[i].People = nil
+	}
+
+	return ret
+}
+
+// colocationMessage describes c for a notification.
+func colocationMessage(c colocation, names map[string]string) string {
+	who := make([]string, 0, len(c.People))
+	for _, id := range c.People {
+		who = append(who, cmp.Or(names[id], id, "hvor"))
+	}
+
+	where := c.Where
+	if c.Watch != "" {
+		where = c.Watch
+	}
+
+	msg := fmt.Sprintf("%s, %s to %s", where, c.From.Format(dateFormat), c.To.Format(dateFormat))
+	if len(who) == 0 {
+		return msg
+	}
+
+	return strings.Join(who, " and ") + ": " + msg
+}
+
+// watchColocations tells the webhooks about co-locations as they are
+// found, until ctx is done.
+func (h *hvor) watchColocations(ctx context.Context, people func() []*hvor) {
+	ticker := time.NewTicker(colocationPoll)
+	defer ticker.Stop()
+
+	told := make(map[string]map[string]bool)
+
+	for {
+		h.checkColocations(people(), told)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkColocations queues the co-locations of people not in told for the
+// webhooks that want them, as each webhook may see them, and records them
+// in told by webhook URL. Those found the first time a webhook is checked
+// are not told, so a restart does not repeat them.
+func (h *hvor) checkColocations(people []*hvor, told map[string]map[string]bool) {
+	cfg := h.config()
+	if h.webhooks == nil {
+		return
+	}
+
+	names := make(map[string]string, len(people))
+	for _, m := range people {
+		who := m.config().person
+		names[who.ID] = who.Name
+	}
+
+	for _, wc := range cfg.Webhooks {
+		if !wc.wants(changeColocation) {
+			continue
+		}
+
+		prev, checked := told[wc.URL]
+		next := make(map[string]bool)
+
+		var changes []change
+
+		for _, c := range colocations(people, cfg.Colocation, viewer{scope: wc.scope}) {
+			next[c.key()] = true
+
+			if checked && !prev[c.key()] {
+				changes = append(changes, change{kind: changeColocation, colocation: &c, names: names})
+			}
+		}
+
+		told[wc.URL] = next
+
+		if len(changes) > 0 {
+			h.webhooks.enqueue(wc, person{}, changes)
+		}
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/tailscale/hujson"
+)
+
+const (
+	defaultMonthsPast   = 6
+	defaultMonthsFuture = 3
+
+	// configPoll is how often the config file is checked for changes.
+	configPoll = 10 * time.Second
+)
+
+// window is how many months of events around now are shown.
+type window struct {
+	past, future int
+}
+
+var (
+	rePersonID = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+	// reservedPersonIDs are the paths a team instance serves itself.
+	reservedPersonIDs = []string{"static", "healthz", "readyz", "metrics", "debug", "overview", "api", "audit"}
+)
+
+var defaultWindow = window{past: defaultMonthsPast, future: defaultMonthsFuture}
+
+// bounds returns the start and end of the window around now.
+func (w window) bounds(now time.Time) (time.Time, time.Time) {
+	return now.AddDate(0, -w.past, 0), now.AddDate(0, w.future, 0)
+}
+
+// duration is a time.Duration written as a string, like "30m".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30m\": %w", err)
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = duration(parsed)
+
+	return nil
+}
+
+// config holds the settings that can change while hvor is running. It is
+// built from the flags, and optionally overlaid with a HuJSON config file:
+//
+//	{
+//	  "sources": ["https://example.com/calendar.ics"],
+//	  "tokens": [{"token": "mum"}, {"token": "friend", "scopes": "city"}],
+//	  "map": {"provider": "mapbox", "token": "pk.…"},
+//	  "display": {"monthsPast": 6, "monthsFuture": 3, "icsDescriptions": false},
+//	  "refresh": {"period": "30m", "readyPeriods": 3},
+//	  "caldavCredentials": "/run/secrets/caldav",
+//	}
+//
+// Zero numbers and durations mean the default.
+//
+// With people, one instance serves each of them at /<id>/ from their own
+// sources, instead of the top-level sources. Top-level tokens then give
+// access to everyone, and the tokens of a person only to them. The CalDAV
+// sources of a person are read with their own credentials, if they have
+// any, and with the top-level ones otherwise:
+//
+//	"people": [
+//	  {"id": "kristoffer", "name": "Kristoffer", "sources": ["…"], "tokens": [{"token": "mum"}]},
+//	  {"id": "kari", "sources": ["caldavs://…"], "caldavCredentials": "/run/secrets/kari-caldav"},
+//	],
+type config struct {
+	Sources []string       `json:"sources"`
+	Tokens  []configToken  `json:"tokens"`
+	People  []personConfig `json:"people"`
+	Map     mapConfig      `json:"map"`
+	Display displayConfig  `json:"display"`
+	Refresh refreshConfig  `json:"refresh"`
+
+	Colocation colocationConfig `json:"colocation"`
+	Webhooks   []webhookConfig  `json:"webhooks"`
+
+	// CalDAVCredentials is the path to the credentials of CalDAV sources,
+	// as read by loadCalDAVAuth.
+	CalDAVCredentials string `json:"caldavCredentials"`
+
+	tokens tokens
+
+	// person is who the config is for, in a team.
+	person person
+}
+
+type personConfig struct {
+	ID      string        `json:"id"`
+	Name    string        `json:"name"`
+	Sources []string      `json:"sources"`
+	Tokens  []configToken `json:"tokens"`
+
+	CalDAVCredentials string `json:"caldavCredentials"`
+
+	tokens tokens
+}
+
+type configToken struct {
+	Token  string `json:"token"`
+	Scopes string `json:"scopes,omitempty"`
+}
+
+type mapConfig struct {
+	Provider string `json:"provider"`
+	Token    string `json:"token"`
+}
+
+type displayConfig struct {
+	MonthsPast      int  `json:"monthsPast"`
+	MonthsFuture    int  `json:"monthsFuture"`
+	ICSDescriptions bool `json:"icsDescriptions"`
+}
+
+type refreshConfig struct {
+	Period       duration `json:"period"`
+	ReadyPeriods int      `json:"readyPeriods"`
+}
+
+// flagConfig returns the config given by flags and the environment.
+func flagConfig() config {
+	return config{
+		Sources: parseSources(*calendarURL),
+		Map: mapConfig{
+			Provider: "mapbox",
+			Token:    *mapboxToken,
+		},
+		Display: displayConfig{
+			MonthsPast:      *monthsPast,
+			MonthsFuture:    *monthsFuture,
+			ICSDescriptions: *icsDescriptions,
+		},
+		Refresh: refreshConfig{
+			Period:       duration(*refreshPeriod),
+			ReadyPeriods: *readyRefreshPeriods,
+		},
+		CalDAVCredentials: *caldavCredentialsPath,
+		tokens:            parseTokens(*fromTokensStr),
+	}
+}
+
+// loadConfig reads the HuJSON config file at path on top of base. Tokens
+// listed in the file replace those of base.
+func loadConfig(path string, base config) (*config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	return parseConfig(data, base)
+}
+
+func parseConfig(data []byte, base config) (*config, error) {
+	data, err := hujson.Standardize(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+
+	cfg := base
+	cfg.Sources = slices.Clone(base.Sources)
+	cfg.Tokens = nil
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("failed to decode config: %w", err)
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	return &cfg, nil
+}
+
+// validate checks the config and builds its tokens.
+func (c *config) validate() error {
+	var errs []error
+
+	// The top-level sources are not used with people.
+	if len(c.People) == 0 {
+		errs = append(errs, validateSources("sources", c.Sources)...)
+	}
+
+	if c.Tokens != nil {
+		var tokErrs []error
+		c.tokens, tokErrs = configTokens("tokens", c.Tokens)
+		errs = append(errs, tokErrs...)
+	}
+
+	ids := make(map[string]bool, len(c.People))
+
+	for i := range c.People {
+		pc := &c.People[i]
+		prefix := fmt.Sprintf("people[%d]", i)
+
+		switch {
+		case !rePersonID.MatchString(pc.ID):
+			errs = append(errs, fmt.Errorf("%s.id: %q must be lowercase letters, digits, - and _", prefix, pc.ID))
+		case slices.Contains(reservedPersonIDs, pc.ID):
+			errs = append(errs, fmt.Errorf("%s.id: %q is used by hvor itself", prefix, pc.ID))
+		case ids[pc.ID]:
+			errs = append(errs, fmt.Errorf("%s.id: duplicate id %q", prefix, pc.ID))
+		}
+
+		ids[pc.ID] = true
+
+		errs = append(errs, validateSources(prefix+".sources", pc.Sources)...)
+
+		var tokErrs []error
+		pc.tokens, tokErrs = configTokens(prefix+".tokens", pc.Tokens)
+		errs = append(errs, tokErrs...)
+	}
+
+	if p := c.Map.Provider; p != "" && p != "mapbox" {
+		errs = append(errs, fmt.Errorf("map.provider: unsupported provider %q, only \"mapbox\" is", p))
+	}
+
+	if c.Display.MonthsPast < 0 || c.Display.MonthsFuture < 0 {
+		errs = append(errs, errors.New("display: months must not be negative"))
+	}
+
+	if p := time.Duration(c.Refresh.Period); p != 0 && p < minBackoff {
+		errs = append(errs, fmt.Errorf("refresh.period: must be at least %s", minBackoff))
+	}
+
+	if c.Refresh.ReadyPeriods < 0 {
+		errs = append(errs, errors.New("refresh.readyPeriods: must not be negative"))
+	}
+
+	errs = append(errs, c.Colocation.validate()...)
+
+	for i := range c.Webhooks {
+		errs = append(errs, c.Webhooks[i].validate(fmt.Sprintf("webhooks[%d]", i))...)
+	}
+
+	return errors.Join(errs...)
+}
+
+func validateSources(field string, sources []string) []error {
+	if len(sources) == 0 {
+		return []error{fmt.Errorf("%s: no calendar sources", field)}
+	}
+
+	var errs []error
+
+	for i, src := range sources {
+		if err := validateSource(src); err != nil {
+			errs = append(errs, fmt.Errorf("%s[%d]: %w", field, i, err))
+		}
+	}
+
+	return errs
+}
+
+// configTokens builds the tokens listed in field.
+func configTokens(field string, cts []configToken) (tokens, []error) {
+	ret := tokens{ts: make(map[string]scope, len(cts))}
+
+	var errs []error
+
+	for i, ct := range cts {
+		if ct.Token == "" {
+			errs = append(errs, fmt.Errorf("%s[%d]: empty token", field, i))
+
+			continue
+		}
+
+		if _, ok := ret.ts[ct.Token]; ok {
+			errs = append(errs, fmt.Errorf("%s[%d]: duplicate token", field, i))
+
+			continue
+		}
+
+		sc := fullScope
+
+		if ct.Scopes != "" {
+			var err error
+			if sc, err = parseScope(ct.Scopes); err != nil {
+				errs = append(errs, fmt.Errorf("%s[%d]: %w", field, i, err))
+
+				continue
+			}
+		}
+
+		ret.ts[ct.Token] = sc
+	}
+
+	return ret, errs
+}
+
+// validateSource checks that src is a source fetchSource can read.
+func validateSource(src string) error {
+	u, err := url.Parse(src)
+	if err != nil {
+		return fmt.Errorf("invalid source: %w", err)
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "", "http", "https", "webcal", "webcals", "caldav", "caldavs", "file":
+		return nil
+	}
+
+	return fmt.Errorf("unsupported calendar source scheme %q", u.Scheme)
+}
+
+// forPerson returns the config of a person of the team: their own
+// sources and CalDAV credentials, and their tokens on top of the team-wide
+// ones.
+func (c *config) forPerson(pc personConfig) *config {
+	ret := *c
+	ret.Sources = pc.Sources
+	ret.CalDAVCredentials = cmp.Or(pc.CalDAVCredentials, c.CalDAVCredentials)
+	ret.Tokens = nil
+	ret.People = nil
+	ret.person = person{ID: pc.ID, Name: cmp.Or(pc.Name, pc.ID)}
+
+	ret.tokens = tokens{ts: make(map[string]scope, len(c.tokens.ts)+len(pc.tokens.ts))}
+	maps.Copy(ret.tokens.ts, c.tokens.ts)
+	maps.Copy(ret.tokens.ts, pc.tokens.ts)
+
+	return &ret
+}
+
+func (c *config) window() window {
+	return window{
+		past:   cmp.Or(c.Display.MonthsPast, defaultMonthsPast),
+		future: cmp.Or(c.Display.MonthsFuture, defaultMonthsFuture),
+	}
+}
+
+// config returns the config in use.
+func (h *hvor) config() *config {
+	if c := h.conf.Load(); c != nil {
+		return c
+	}
+
+	return &config{}
+}
+
+// reloadConfig loads the config file again and swaps it in, keeping the
+// config in use if the new one is invalid.
+func (h *hvor) reloadConfig() error {
+	if h.configPath == "" {
+		return nil
+	}
+
+	info, err := os.Stat(h.configPath)
+	if err != nil {
+		return fmt.Errorf("failed to read config: %w", err)
+	}
+
+	cfg, err := loadConfig(h.configPath, h.baseConfig)
+	if err != nil {
+		return err
+	}
+
+	if cur := h.conf.Load(); cur != nil && (len(cur.People) > 0) != (len(cfg.People) > 0) {
+		return errors.New("switching between one person and people needs a restart")
+	}
+
+	h.conf.Store(cfg)
+	h.configStat.Store(&fileStat{modTime: info.ModTime(), size: info.Size()})
+
+	return nil
+}
+
+// fileStat identifies a version of a file.
+type fileStat struct {
+	modTime time.Time
+	size    int64
+}
+
+// watchConfig reloads the config file as it changes, until ctx is done,
+// and calls reloaded after every successful reload.
+func (h *hvor) watchConfig(ctx context.Context, reloaded func()) {
+	ticker := time.NewTicker(configPoll)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			info, err := os.Stat(h.configPath)
+			if err != nil {
+				h.logf("failed to check config: %s", err)
+
+				continue
+			}
+
+			if prev := h.configStat.Load(); prev != nil && prev.modTime.Equal(info.ModTime()) && prev.size == info.Size() {
+				continue
+			}
+
+			if err := h.reloadConfig(); err != nil {
+				h.logf("failed to reload config, keeping the config in use: %s", err)
+				// Do not retry the same broken file every poll.
+				h.configStat.Store(&fileStat{modTime: info.ModTime(), size: info.Size()})
+
+				continue
+			}
+
+			h.logf("reloaded config from %s", h.configPath)
+			reloaded()
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	earthRadius   = 6371008.8 // metres, mean radius
+	circleSegment = 64
+)
+
+// stop is a located event, the unit of every export.
+type stop struct {
+	pageEvent
+
+	lat, lon float64
+}
+
+// stops returns the located events of p in the given span, "past",
+// "future" or "all", ordered by when they start.
+func stops(p *page, span string) ([]stop, error) {
+	var es pageEvents
+
+	switch span {
+	case "", "all":
+		es = append(es, p.Past...)
+		if p.Current != nil {
+			es = append(es, *p.Current)
+		}
+
+		es = append(es, p.Concurrent...)
+		es = append(es, p.Future...)
+	case "past":
+		es = p.Past
+	case "future":
+		es = p.Future
+	default:
+		return nil, fmt.Errorf("unknown window %q", span)
+	}
+
+	var ret []stop
+
+	for _, pe := range es {
+		if pe.Location == nil {
+			continue
+		}
+
+		lat, err := strconv.ParseFloat(pe.Location.Latitude, 64)
+		if err != nil {
+			continue
+		}
+
+		lon, err := strconv.ParseFloat(pe.Location.Longitude, 64)
+		if err != nil {
+			continue
+		}
+
+		ret = append(ret, stop{pageEvent: pe, lat: lat, lon: lon})
+	}
+
+	slices.SortStableFunc(ret, func(a, b stop) int {
+		return a.From.Compare(b.From)
+	})
+
+	return ret, nil
+}
+
+// circle approximates the area within radius metres of lat, lon as a
+// closed ring of [lon, lat] positions.
+func circle(lat, lon, radius float64) [][2]float64 {
+	lat1 := lat * math.Pi / 180
+	lon1 := lon * math.Pi / 180
+	dist := radius / earthRadius
+
+	ring := make([][2]float64, 0, circleSegment+1)
+
+	for i := range circleSegment {
+		bearing := 2 * math.Pi * float64(i) / circleSegment
+
+		lat2 := math.Asin(math.Sin(lat1)*math.Cos(dist) + math.Cos(lat1)*math.Sin(dist)*math.Cos(bearing))
+		lon2 := lon1 + math.Atan2(
+			math.Sin(bearing)*math.Sin(dist)*math.Cos(lat1),
+			math.Cos(dist)-math.Sin(lat1)*math.Sin(lat2),
+		)
+
+		ring = append(ring, [2]float64{
+			math.Remainder(lon2*180/math.Pi, 360),
+			lat2 * 180 / math.Pi,
+		})
+	}
+
+	return append(ring, ring[0])
+}
+
+type geoJSONCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+type geoJSONFeature struct {
+	Type       string         `json:"type"`
+	Geometry   geoJSONGeom    `json:"geometry"`
+	Properties map[string]any `json:"properties"`
+}
+
+type geoJSONGeom struct {
+	Type        string `json:"type"`
+	Coordinates any    `json:"coordinates"`
+}
+
+func stopProperties(s stop, kind string) map[string]any {
+	return map[string]any{
+		"kind":    kind,
+		"summary": s.Summary,
+		"title":   s.Location.Title,
+		"from":    s.From,
+		"to":      s.To,
+		"allDay":  s.AllDay,
+		"radius":  s.Location.Radius,
+	}
+}
+
+// geoJSON returns a FeatureCollection with a point for every stop, a
+// polygon for those with a radius, and a line through all of them in
+// order.
+func geoJSON(ss []stop) geoJSONCollection {
+	fc := geoJSONCollection{
+		Type:     "FeatureCollection",
+		Features: []geoJSONFeature{},
+	}
+
+	line := make([][2]float64, 0, len(ss))
+
+	for _, s := range ss {
+		fc.Features = append(fc.Features, geoJSONFeature{
+			Type:       "Feature",
+			Geometry:   geoJSONGeom{Type: "Point", Coordinates: [2]float64{s.lon, s.lat}},
+			Properties: stopProperties(s, "stop"),
+		})
+
+		if s.Location.Radius > 0 {
+			fc.Features = append(fc.Features, geoJSONFeature{
+				Type: "Feature",
+				Geometry: geoJSONGeom{
+					Type:        "Polygon",
+					Coordinates: [][][2]float64{circle(s.lat, s.lon, s.Location.Radius)},
+				},
+				Properties: stopProperties(s, "radius"),
+			})
+		}
+
+		line = append(line, [2]float64{s.lon, s.lat})
+	}
+
+	if len(line) > 1 {
+		fc.Features = append(fc.Features, geoJSONFeature{
+			Type:       "Feature",
+			Geometry:   geoJSONGeom{Type: "LineString", Coordinates: line},
+			Properties: map[string]any{"kind": "travel"},
+		})
+	}
+
+	return fc
+}
+
+type kmlDocument struct {
+	XMLName    xml.Name       `xml:"http://www.opengis.net/kml/2.2 kml"`
+	Name       string         `xml:"Document>name"`
+	Placemarks []kmlPlacemark `xml:"Document>Placemark"`
+}
+
+type kmlPlacemark struct {
+	Name        string        `xml:"name"`
+	Description string        `xml:"description,omitempty"`
+	TimeSpan    *kmlTimeSpan  `xml:"TimeSpan,omitempty"`
+	Point       *kmlGeometry  `xml:"Point,omitempty"`
+	LineString  *kmlGeometry  `xml:"LineString,omitempty"`
+	Polygon     *kmlPolygon   `xml:"Polygon,omitempty"`
+	Geometries  *kmlMultiGeom `xml:"MultiGeometry,omitempty"`
+}
+
+type kmlTimeSpan struct {
+	Begin string `xml:"begin"`
+	End   string `xml:"end"`
+}
+
+type kmlGeometry struct {
+	Coordinates string `xml:"coordinates"`
+}
+
+type kmlPolygon struct {
+	Coordinates string `xml:"outerBoundaryIs>LinearRing>coordinates"`
+}
+
+type kmlMultiGeom struct {
+	Point   kmlGeometry `xml:"Point"`
+	Polygon kmlPolygon  `xml:"Polygon"`
+}
+
+func kmlCoordinates(positions [][2]float64) string {
+	var b []byte
+
+	for i, pos := range positions {
+		if i > 0 {
+			b = append(b, ' ')
+		}
+
+		b = strconv.AppendFloat(b, pos[0], 'f', -1, 64)
+		b = append(b, ',')
+		b = strconv.AppendFloat(b, pos[1], 'f', -1, 64)
+	}
+
+	return string(b)
+}
+
+// kml returns a KML document with a placemark for every stop, spanning its
+// dates, and a line through all of them in order.
+func kml(ss []stop) kmlDocument {
+	doc := kmlDocument{Name: "hvor"}
+
+	line := make([][2]float64, 0, len(ss))
+
+	for _, s := range ss {
+		pos := [2]float64{s.lon, s.lat}
+		pm := kmlPlacemark{
+			Name:        s.Summary,
+			Description: s.Location.Title,
+			TimeSpan: &kmlTimeSpan{
+				Begin: s.From.Format(time.RFC3339),
+				End:   s.To.Format(time.RFC3339),
+			},
+		}
+
+		if s.Location.Radius > 0 {
+			pm.Geometries = &kmlMultiGeom{
+				Point:   kmlGeometry{Coordinates: kmlCoordinates([][2]float64{pos})},
+				Polygon: kmlPolygon{Coordinates: kmlCoordinates(circle(s.lat, s.lon, s.Location.Radius))},
+			}
+		} else {
+			pm.Point = &kmlGeometry{Coordinates: kmlCoordinates([][2]float64{pos})}
+		}
+
+		doc.Placemarks = append(doc.Placemarks, pm)
+		line = append(line, pos)
+	}
+
+	if len(line) > 1 {
+		doc.Placemarks = append(doc.Placemarks, kmlPlacemark{
+			Name:       "Travel",
+			LineString: &kmlGeometry{Coordinates: kmlCoordinates(line)},
+		})
+	}
+
+	return doc
+}
+
+type gpxDocument struct {
+	XMLName   xml.Name   `xml:"http://www.topografix.com/GPX/1/1 gpx"`
+	Version   string     `xml:"version,attr"`
+	Creator   string     `xml:"creator,attr"`
+	Waypoints []gpxPoint `xml:"wpt"`
+	Track     *gpxTrack  `xml:"trk,omitempty"`
+}
+
+type gpxPoint struct {
+	Lat         float64 `xml:"lat,attr"`
+	Lon         float64 `xml:"lon,attr"`
+	Time        string  `xml:"time,omitempty"`
+	Name        string  `xml:"name,omitempty"`
+	Description string  `xml:"desc,omitempty"`
+}
+
+type gpxTrack struct {
+	Name   string     `xml:"name"`
+	Points []gpxPoint `xml:"trkseg>trkpt"`
+}
+
+// gpx returns a GPX document with a waypoint for every stop and a track
+// through all of them in order. GPX has no notion of an area, so the
+// radius is left out.
+func gpx(ss []stop) gpxDocument {
+	doc := gpxDocument{Version: "1.1", Creator: "hvor"}
+
+	var track []gpxPoint
+
+	for _, s := range ss {
+		pt := gpxPoint{
+			Lat:         s.lat,
+			Lon:         s.lon,
+			Time:        s.From.UTC().Format(time.RFC3339),
+			Name:        s.Summary,
+			Description: s.Location.Title,
+		}
+
+		doc.Waypoints = append(doc.Waypoints, pt)
+		track = append(track, gpxPoint{Lat: s.lat, Lon: s.lon, Time: pt.Time})
+	}
+
+	if len(track) > 1 {
+		doc.Track = &gpxTrack{Name: "Travel", Points: track}
+	}
+
+	return doc
+}
+
+// exportHandler serves the located events of the window given in the
+// query, past, future or all, in the format of the route, with the same
+// access rules as the HTML page.
+func (h *hvor) exportHandler(format string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v, ok := h.authorise(w, r, accessToken)
+		if !ok {
+			return
+		}
+
+		s := h.snap.Load()
+
+		ss, err := stops(s.calPage.restrict(v.scope), r.URL.Query().Get("window"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+
+			return
+		}
+
+		var doc any
+
+		switch format {
+		case "geojson":
+			w.Header().Set("Content-Type", "application/geo+json")
+			_ = json.NewEncoder(w).Encode(geoJSON(ss))
+
+			return
+		case "kml":
+			w.Header().Set("Content-Type", "application/vnd.google-earth.kml+xml")
+			doc = kml(ss)
+		case "gpx":
+			w.Header().Set("Content-Type", "application/gpx+xml")
+			doc = gpx(ss)
+		}
+
+		_, _ = w.Write([]byte(xml.Header))
+
+		enc := xml.NewEncoder(w)
+		enc.Indent("", "  ")
+		_ = enc.Encode(doc)
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+// feedCalendar builds a calendar of the events hvor shows, for others to
+// subscribe to. Only what the page shows is included: summaries, cleaned
+// location titles and coordinates, and descriptions if withDescriptions
+// is set. Everything else of the private calendar is left out. Subscribers
+// are asked to refresh every period.
+func feedCalendar(p *page, withDescriptions bool, period time.Duration, now time.Time) *ics.Calendar {
+	cal := ics.NewCalendarFor("hvor")
+	cal.SetMethod(ics.MethodPublish)
+	cal.SetXWRCalName("hvor")
+	cal.SetRefreshInterval("PT" + strconv.Itoa(int(period.Minutes())) + "M")
+
+	var es pageEvents
+
+	es = append(es, p.Past...)
+	if p.Current != nil {
+		es = append(es, *p.Current)
+	}
+
+	es = append(es, p.Concurrent...)
+	es = append(es, p.Future...)
+
+	for _, pe := range es {
+		addFeedEvent(cal, pe, withDescriptions, now)
+	}
+
+	return cal
+}
+
+func addFeedEvent(cal *ics.Calendar, pe pageEvent, withDescriptions bool, now time.Time) {
+	// Recurring events share their UID, so the start of each
+	// occurrence is part of the published one.
+	event := cal.AddEvent(fmt.Sprintf("%s-%s@hvor", pe.UID, pe.From.UTC().Format(icalDateTimeFormat)))
+	event.SetDtStampTime(now)
+	event.SetSummary(pe.Summary)
+
+	if pe.AllDay {
+		event.SetAllDayStartAt(pe.From)
+		event.SetAllDayEndAt(pe.To)
+	} else {
+		event.SetStartAt(pe.From)
+		event.SetEndAt(pe.To)
+	}
+
+	if withDescriptions && len(pe.Description) > 0 {
+		event.SetDescription(strings.Join(pe.Description, "\n"))
+	}
+
+	loc := pe.Location
+	if loc == nil {
+		return
+	}
+
+	if loc.Title != "" {
+		event.SetLocation(loc.Title)
+	}
+
+	if loc.Latitude == "" || loc.Longitude == "" {
+		return
+	}
+
+	params := []ics.PropertyParameter{
+		&ics.KeyValues{Key: "VALUE", Value: []string{"URI"}},
+		&ics.KeyValues{Key: "X-TITLE", Value: []string{loc.Title}},
+	}
+
+	if loc.Radius > 0 {
+		params = append(params, &ics.KeyValues{
+			Key:   "X-APPLE-RADIUS",
+			Value: []string{strconv.FormatFloat(loc.Radius, 'f', -1, 64)},
+		})
+	}
+
+	if loc.MapkitHandle != "" {
+		params = append(params, &ics.KeyValues{Key: "X-APPLE-MAPKIT-HANDLE", Value: []string{loc.MapkitHandle}})
+	}
+
+	event.AddProperty(
+		ics.ComponentProperty("X-APPLE-STRUCTURED-LOCATION"),
+		"geo:"+loc.Latitude+","+loc.Longitude,
+		params...,
+	)
+	event.SetGeo(loc.Latitude, loc.Longitude)
+}
+
+// icsHandler serves the shown events as an iCal feed, with the same access
+// rules as the HTML page so a subscription URL can carry a from token.
+func (h *hvor) icsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v, ok := h.authorise(w, r, accessToken)
+		if !ok {
+			return
+		}
+
+		s := h.snap.Load()
+
+		w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+		w.Header().Set("Content-Disposition", `inline; filename="hvor.ics"`)
+		_, _ = w.Write([]byte(feedCalendar(s.calPage.restrict(v.scope), h.config().Display.ICSDescriptions, h.period(), time.Now()).Serialize()))
+	})
+}
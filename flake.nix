@@ -21,7 +21,7 @@
         if (self ? shortRev)
         then self.shortRev
         else "dev";
-      vendorHash = "sha256-EDepL94RgmZqGgVs/zbWgLzuObMWLl2Y1VY/2zJoVRU=";
+      vendorHash = "sha256-/P3iZW59zlakMxwampdtE0CiwEU4Ifgh/Bcb3yodlt8=";
     in
     {
       overlays.default = _: prev:
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// updateError is the error of the last update, if it failed.
+type updateError struct {
+	err  error
+	time time.Time
+}
+
+// recordUpdate remembers the outcome of an update for /readyz.
+func (h *hvor) recordUpdate(err error) {
+	if err == nil {
+		h.lastUpdateErr.Store(nil)
+
+		return
+	}
+
+	h.lastUpdateErr.Store(&updateError{err: err, time: time.Now()})
+}
+
+// readiness is the detail behind /readyz.
+type readiness struct {
+	Ready         bool           `json:"ready"`
+	Reason        string         `json:"reason,omitempty"`
+	LastFetch     time.Time      `json:"lastFetch,omitzero"`
+	Age           string         `json:"age,omitempty"`
+	MaxAge        string         `json:"maxAge"`
+	Stale         bool           `json:"stale"`
+	Events        map[string]int `json:"events,omitempty"`
+	Sources       []sourceHealth `json:"sources,omitempty"`
+	LastError     string         `json:"lastError,omitempty"`
+	LastErrorTime time.Time      `json:"lastErrorTime,omitzero"`
+}
+
+// readiness reports whether hvor has calendar data fresh enough to serve:
+// fetched successfully within readyPeriods refresh periods.
+func (h *hvor) readiness(now time.Time) readiness {
+	maxAge := time.Duration(max(h.config().Refresh.ReadyPeriods, 1)) * h.period()
+
+	ret := readiness{MaxAge: maxAge.String()}
+
+	if ue := h.lastUpdateErr.Load(); ue != nil {
+		msg := ue.err.Error()
+		for _, src := range h.config().Sources {
+			msg = redactError(msg, src)
+		}
+
+		ret.LastError = msg
+		ret.LastErrorTime = ue.time
+	}
+
+	s := h.snap.Load()
+	if s == nil {
+		ret.Reason = "no calendar data yet"
+
+		return ret
+	}
+
+	age := now.Sub(s.lastFetch)
+
+	ret.LastFetch = s.lastFetch
+	ret.Age = age.Round(time.Second).String()
+	ret.Stale = s.stale
+	ret.Sources = s.health()
+
+	if p := s.calPage; p != nil {
+		current := len(p.Concurrent)
+		if p.Current != nil {
+			current++
+		}
+
+		ret.Events = map[string]int{
+			"past":    len(p.Past),
+			"current": current,
+			"future":  len(p.Future),
+		}
+	}
+
+	if age > maxAge {
+		ret.Reason = "calendar data is older than " + ret.MaxAge
+
+		return ret
+	}
+
+	ret.Ready = true
+
+	return ret
+}
+
+// healthzHandler reports that the process is up.
+func (h *hvor) healthzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"ok"}` + "\n"))
+	})
+}
+
+// readyzHandler reports whether hvor has fresh calendar data, with 503 if
+// not. It is served to anyone, so the detail of readinessHandler is only
+// given with ?verbose to the full scope.
+func (h *hvor) readyzHandler() http.Handler {
+	detail := h.readinessHandler()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("verbose") {
+			if h.authoriseFull(w, r) {
+				detail.ServeHTTP(w, r)
+			}
+
+			return
+		}
+
+		ready := h.readiness(time.Now()).Ready
+
+		writeReadiness(w, ready, struct {
+			Ready bool `json:"ready"`
+		}{ready})
+	})
+}
+
+// readinessHandler reports the readiness of hvor in detail, for the debug
+// handler and /readyz?verbose.
+func (h *hvor) readinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		ready := h.readiness(time.Now())
+
+		writeReadiness(w, ready.Ready, ready)
+	})
+}
+
+// writeReadiness writes v as JSON, with 503 if not ready.
+func writeReadiness(w http.ResponseWriter, ready bool, v any) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"time"
 
@@ -12,6 +13,7 @@ import (
 var (
 	dateFormat     string = "Monday 02. January 2006"
 	dateTimeFormat string = "Monday 02. January 2006 15:04"
+	timeZoneFormat string = "Monday 02. January 2006 15:04 MST"
 )
 
 func BasePage(props a.Props, children ...Node) *Element {
@@ -35,7 +37,7 @@ func BasePage(props a.Props, children ...Node) *Element {
 			Title(nil, Text("hvor")),
 			Link(a.Props{
 				a.Rel:  "stylesheet",
-				a.Href: "static/tailwind.css",
+				a.Href: "/static/tailwind.css",
 			}),
 			Link(a.Props{
 				a.Rel:  "stylesheet",
@@ -53,6 +55,7 @@ func BasePage(props a.Props, children ...Node) *Element {
 				"data-website-id": "0de65a1e-5275-4e39-a78e-364e704c0867",
 			}),
 			Script(a.Props{a.Src: "https://unpkg.com/htmx.org@1.9.10"}),
+			Script(a.Props{a.Src: "https://unpkg.com/htmx.org@1.9.10/dist/ext/sse.js"}),
 		),
 		Body(
 			props,
@@ -63,17 +66,91 @@ func BasePage(props a.Props, children ...Node) *Element {
 	return content
 }
 
-func hvorPage(p *page, mapboxToken string, lastFetch time.Time) *Element {
-	var mapElement, mapScript *Element
+func hvorPage(p *page, who person, nearby []colocation, mapboxToken string, fresh freshness) *Element {
+	return BasePage(
+		nil,
+		Div(
+			a.Props{
+				a.Class: "w-full md:w-2/3 lg:w-1/2 mx-auto",
+			},
+			nav(who),
+			Main(
+				a.Props{
+					a.Class: "px-4 py-6",
+				},
+				// The current whereabouts are replaced over SSE whenever
+				// they change, so a wall display does not need reloading.
+				Div(
+					a.Props{
+						x.HXExt:      "sse",
+						x.SSEConnect: who.base() + "/events",
+					},
+					Div(
+						a.Props{
+							a.ID:      "current",
+							x.SSESwap: "current",
+						},
+						currentFragment(p, mapboxToken)...,
+					),
+				),
+				colocationList("Nearby", nearby, nil),
+				Div(
+					nil,
+					H2(
+						a.Props{
+							a.Class: "text-2xl md:text-3xl text-gray-600 mt-12",
+						}, Text("Next"),
+					),
+					Div(nil,
+						events(p.Future, who.base(), "future", 0, 5)...),
+				),
+				Div(
+					nil,
+					H2(
+						a.Props{
+							a.Class: "text-2xl md:text-3xl text-gray-600 mt-12",
+						}, Text("Past"),
+					),
+					Div(nil, events(p.Past, who.base(), "past", 0, 5)...),
+				),
+			),
+			footer(fresh),
+		),
+	)
+}
 
-	if p.Current != nil && p.Current.Location != nil {
-		mapElement = Div(a.Props{
-			a.ID:    "map",
-			a.Class: "mt-4 h-72",
-		})
+// currentFragment renders the map and the current events; it is both
+// part of the page and what is pushed to live clients.
+func currentFragment(p *page, mapboxToken string) []Node {
+	if p.Current == nil || p.Current.Location == nil {
+		return []Node{
+			Div(
+				a.Props{
+					a.Class: "mt-4 h-72 bg-gray-100 rounded-lg flex items-center justify-center",
+				},
+				P(
+					a.Props{
+						a.Class: "text-gray-500 text-lg",
+					},
+					Text("Unknown whereabouts"),
+				),
+			),
+			currentEvent(p.Current),
+			concurrentEvents(p.Concurrent),
+		}
+	}
 
-		mapScript = Script(nil, Text(fmt.Sprintf(
-			`
+	minZoom, zoomLimit := 9, ""
+	if maxZoom := p.Precision.maxZoom(); maxZoom > 0 {
+		minZoom = min(minZoom, maxZoom)
+		zoomLimit = fmt.Sprintf("\n  maxZoom: %d,", maxZoom)
+	}
+
+	// The script is a block so it can run again when the fragment is
+	// swapped in without redeclaring its variables.
+	mapScript := Script(nil, Text(fmt.Sprintf(
+		`
+{
 mapboxgl.accessToken = '%s';
 
 let center = [%s, %s]
@@ -82,8 +159,8 @@ const map = new mapboxgl.Map({
   style: 'mapbox://styles/mapbox/streets-v12',
   center: center,
   scrollZoom: false,
-  zoom: 9,
-  minZoom: 9,
+  zoom: %d,
+  minZoom: %d,%s
 });
 
 map.on('load', function() {
@@ -94,94 +171,308 @@ map.on('load', function() {
 
   map.fitBounds(new mapboxgl.LngLatBounds(circle.geometry.coordinates[0][0], circle.geometry.coordinates[0][2]), {padding: 50});
 })
+}
 `,
-			mapboxToken,
-			p.Current.Location.Longitude,
-			p.Current.Location.Latitude,
-			p.Current.Location.Radius/1000,
-		)))
-	} else {
-		mapElement = Div(
+		mapboxToken,
+		p.Current.Location.Longitude,
+		p.Current.Location.Latitude,
+		minZoom,
+		minZoom,
+		zoomLimit,
+		p.Current.Location.Radius/1000,
+	)))
+
+	return []Node{
+		Div(a.Props{
+			a.ID:    "map",
+			a.Class: "mt-4 h-72",
+		}),
+		mapScript,
+		currentEvent(p.Current),
+		concurrentEvents(p.Concurrent),
+	}
+}
+
+// nav is the header of every page. The logo leads to the index, and in a
+// team the name of who is shown follows it.
+func nav(who person) Node {
+	return Nav(
+		a.Props{},
+		Span(
 			a.Props{
-				a.Class: "mt-4 h-72 bg-gray-100 rounded-lg flex items-center justify-center",
+				a.Class: "p-4 flex items-center",
 			},
-			P(
+			A(
 				a.Props{
-					a.Class: "text-gray-500 text-lg",
+					a.Href:  "/",
+					a.Class: "flex items-center",
 				},
-				Text("Unknown whereabouts"),
+				Img(
+					a.Props{
+						a.Class: "h-12 md:h-16 mr-4",
+						a.Src:   "/static/location.svg",
+					},
+				),
+				H1(
+					a.Props{
+						a.Class: "text-3xl md:text-4xl text-gray-700 uppercase",
+					}, Text("Hvor"),
+				),
 			),
-		)
-		mapScript = nil
-	}
+			If[Node](who.Name != "", A(
+				a.Props{
+					a.Href:  who.base() + "/",
+					a.Class: "ml-4 text-2xl md:text-3xl text-gray-500",
+				}, Text(who.Name),
+			), None()),
+		),
+	)
+}
 
+// teamPage is the index of a team, linking to everyone in it.
+func teamPage(people []person) *Element {
 	return BasePage(
 		nil,
 		Div(
 			a.Props{
 				a.Class: "w-full md:w-2/3 lg:w-1/2 mx-auto",
 			},
-			Nav(
-				a.Props{},
+			nav(person{}),
+			Main(
+				a.Props{
+					a.Class: "px-4 py-6",
+				},
 				A(
 					a.Props{
-						a.Href: "/",
-					},
-					Span(
+						a.Href:  "/overview",
+						a.Class: "text-gray-600 underline",
+					}, Text("Where is everyone?"),
+				),
+				Ul(nil, TransformEach(people, func(p person) Node {
+					return Li(
 						a.Props{
-							a.Class: "p-4 flex items-center",
+							a.Class: "mt-5",
 						},
-						Img(
-							a.Props{
-								a.Class: "h-12 md:h-16 mr-4",
-								a.Src:   "./static/location.svg",
-							},
-						),
-						H1(
+						A(
 							a.Props{
-								a.Class: "text-3xl md:text-4xl text-gray-700 uppercase",
-							}, Text("Hvor"),
+								a.Href:  p.base() + "/",
+								a.Class: "font-bold text-xl text-blue-400 underline",
+							}, Text(p.Name),
 						),
-					),
-				),
+					)
+				})...),
 			),
+		),
+	)
+}
+
+// overviewPage shows where everyone in the team is, with everyone who is
+// somewhere known on one map.
+func overviewPage(o overview, prec precision, mapboxToken string) *Element {
+	type marker struct {
+		Name string  `json:"name"`
+		Lng  float64 `json:"lng"`
+		Lat  float64 `json:"lat"`
+	}
+
+	var markers []marker
+
+	names := make(map[string]string, len(o.People))
+
+	for _, op := range o.People {
+		names[op.ID] = op.Name
+
+		if op.Current == nil || op.Current.Location == nil {
+			continue
+		}
+
+		if loc := op.Current.Location; loc.Latitude != nil && loc.Longitude != nil {
+			markers = append(markers, marker{Name: op.Name, Lng: *loc.Longitude, Lat: *loc.Latitude})
+		}
+	}
+
+	mapElement, mapScript := Node(None()), Node(None())
+
+	if len(markers) > 0 {
+		maxZoom := prec.maxZoom()
+		if maxZoom == 0 {
+			maxZoom = 12
+		}
+
+		// Marshalled JSON has <, > and & escaped, so it is safe in a script.
+		data, _ := json.Marshal(markers)
+
+		mapElement = Div(a.Props{
+			a.ID:    "map",
+			a.Class: "mt-4 h-96",
+		})
+
+		mapScript = Script(nil, Text(fmt.Sprintf(
+			`
+{
+mapboxgl.accessToken = '%s';
+
+const people = %s;
+const map = new mapboxgl.Map({
+  container: 'map',
+  style: 'mapbox://styles/mapbox/streets-v12',
+  center: [people[0].lng, people[0].lat],
+  scrollZoom: false,
+  zoom: 2,
+  maxZoom: %d,
+});
+
+const bounds = new mapboxgl.LngLatBounds();
+for (const p of people) {
+  new mapboxgl.Marker().setLngLat([p.lng, p.lat]).setPopup(new mapboxgl.Popup().setText(p.name)).addTo(map);
+  bounds.extend([p.lng, p.lat]);
+}
+
+map.on('load', function() {
+  map.fitBounds(bounds, {padding: 50, maxZoom: %d});
+})
+}
+`,
+			mapboxToken,
+			data,
+			maxZoom,
+			min(maxZoom, 9),
+		)))
+	}
+
+	return BasePage(
+		nil,
+		Div(
+			a.Props{
+				a.Class: "w-full md:w-2/3 lg:w-1/2 mx-auto",
+			},
+			nav(person{}),
 			Main(
 				a.Props{
 					a.Class: "px-4 py-6",
 				},
 				mapElement,
-				currentEvent(p.Current),
-				Div(
-					nil,
-					H2(
-						a.Props{
-							a.Class: "text-2xl md:text-3xl text-gray-600 mt-12",
-						}, Text("Next"),
-					),
-					Div(nil,
-						events(p.Future, "future", 0, 5)...),
-				),
-				Div(
-					nil,
-					H2(
-						a.Props{
-							a.Class: "text-2xl md:text-3xl text-gray-600 mt-12",
-						}, Text("Past"),
-					),
-					Div(nil, events(p.Past, "past", 0, 5)...),
-				),
-			),
-			Footer(
-				a.Props{
-					a.Class: "px-4 py-6 text-sm text-gray-400",
-				},
-				Text(fmt.Sprintf("Last updated: %s", lastFetch.Format(dateTimeFormat))),
+				Div(nil, TransformEach(o.People, func(op overviewPerson) Node {
+					return overviewCard(op)
+				})...),
+				colocationList("Together", o.Colocations, names),
 			),
 			mapScript,
 		),
 	)
 }
 
+// overviewCard is where one person of the team is, and is going next.
+func overviewCard(op overviewPerson) *Element {
+	where := "Unknown whereabouts"
+
+	if cur := op.Current; cur != nil {
+		where = cur.Summary
+		if cur.Location != nil && cur.Location.Title != "" {
+			where = cur.Location.Title
+		}
+	}
+
+	var localTime Node = None()
+	if !op.LocalTime.IsZero() {
+		localTime = P(
+			a.Props{a.Class: "text-sm text-gray-600"},
+			Text("Local time: "+op.LocalTime.Format("Monday 15:04 MST")),
+		)
+	}
+
+	var next Node = None()
+	if n := op.Next; n != nil {
+		next = P(
+			a.Props{a.Class: "text-sm text-gray-600"},
+			Text(fmt.Sprintf("Next: %s, from %s", n.Summary, formatEventTime(pageEvent{AllDay: n.AllDay}, n.From))),
+		)
+	}
+
+	return Div(
+		a.Props{
+			a.Class: "mt-6",
+		},
+		A(
+			a.Props{
+				a.Href:  "/" + op.ID + "/",
+				a.Class: "font-bold text-xl text-gray-700 underline",
+			}, Text(op.Name),
+		),
+		P(a.Props{a.Class: "text-gray-700 mt-1"}, Text(where)),
+		localTime,
+		next,
+	)
+}
+
+// colocationList lists when people are close to each other or to watched
+// places, named by names.
+func colocationList(title string, cs []colocation, names map[string]string) Node {
+	if len(cs) == 0 {
+		return None()
+	}
+
+	return Div(
+		a.Props{
+			a.Class: "mt-8",
+		},
+		H3(
+			a.Props{
+				a.Class: "text-xl text-gray-600",
+			}, Text(title),
+		),
+		Ul(nil, TransformEach(cs, func(c colocation) Node {
+			return Li(
+				a.Props{a.Class: "mt-2 text-gray-700"},
+				Text(colocationMessage(c, names)),
+			)
+		})...),
+	)
+}
+
+// freshness describes how up to date the shown data is.
+type freshness struct {
+	lastFetch   time.Time
+	stale       bool
+	sources     int
+	unavailable int
+}
+
+func footer(fresh freshness) *Element {
+	if fresh.stale {
+		return Footer(
+			a.Props{
+				a.Class: "px-4 py-6 text-sm text-amber-600",
+			},
+			Text(fmt.Sprintf(
+				"Stale since: %s, the calendar could not be fetched",
+				fresh.lastFetch.Format(dateTimeFormat),
+			)),
+		)
+	}
+
+	if fresh.unavailable > 0 {
+		return Footer(
+			a.Props{
+				a.Class: "px-4 py-6 text-sm text-amber-600",
+			},
+			Text(fmt.Sprintf(
+				"Last updated: %s, %d of %d calendars could not be fetched",
+				fresh.lastFetch.Format(dateTimeFormat),
+				fresh.unavailable,
+				fresh.sources,
+			)),
+		)
+	}
+
+	return Footer(
+		a.Props{
+			a.Class: "px-4 py-6 text-sm text-gray-400",
+		},
+		Text(fmt.Sprintf("Last updated: %s", fresh.lastFetch.Format(dateTimeFormat))),
+	)
+}
+
 func currentEvent(pe *pageEvent) Node {
 	if pe == nil {
 		return None()
@@ -190,6 +481,28 @@ func currentEvent(pe *pageEvent) Node {
 	return event(*pe)
 }
 
+// concurrentEvents lists the events that also span now, but lost to
+// Current.
+func concurrentEvents(es pageEvents) Node {
+	if len(es) == 0 {
+		return None()
+	}
+
+	return Div(
+		a.Props{
+			a.Class: "mt-8",
+		},
+		H3(
+			a.Props{
+				a.Class: "text-xl text-gray-600",
+			}, Text("Also"),
+		),
+		Div(nil, TransformEach(es, func(pe pageEvent) Node {
+			return event(pe)
+		})...),
+	)
+}
+
 func event(pe pageEvent) *Element {
 	return Div(
 		a.Props{
@@ -211,14 +524,24 @@ func event(pe pageEvent) *Element {
 			a.Props{
 				a.Class: "flex justify-end flex-col md:flex-row mt-4 text-gray-600 text-right",
 			},
-			P(a.Props{a.Class: "text-sm"}, Text(pe.From.Format(dateFormat))),
+			P(a.Props{a.Class: "text-sm"}, Text(formatEventTime(pe, pe.From))),
 			P(a.Props{a.Class: "text-sm md:mx-1"}, Text("to")),
-			P(a.Props{a.Class: "text-sm"}, Text(pe.To.Format(dateFormat))),
+			P(a.Props{a.Class: "text-sm"}, Text(formatEventTime(pe, pe.To))),
 		),
 	)
 }
 
-func events(es pageEvents, typ string, from, to int) []Node {
+// formatEventTime formats one end of an event. Timed events are shown in
+// the zone they were given in, so a landing in Tokyo reads in Tokyo time.
+func formatEventTime(pe pageEvent, t time.Time) string {
+	if pe.AllDay {
+		return t.Format(dateFormat)
+	}
+
+	return t.Format(timeZoneFormat)
+}
+
+func events(es pageEvents, base, typ string, from, to int) []Node {
 	if from < 0 {
 		from = 0
 	}
@@ -237,7 +560,7 @@ func events(es pageEvents, typ string, from, to int) []Node {
 
 	more := If[Node](to != len(es), Div(a.Props{
 		a.ID:       fmt.Sprintf("replaceMe%s", typ),
-		x.HXGet:    fmt.Sprintf("/%s?from=%d&to=%d", typ, to, to+5),
+		x.HXGet:    fmt.Sprintf("%s/%s?from=%d&to=%d", base, typ, to, to+5),
 		x.HXTarget: fmt.Sprintf("#replaceMe%s", typ),
 		x.HXSwap:   "outerHTML",
 		a.Class:    "italic text-blue-400 underline",
@@ -245,3 +568,53 @@ func events(es pageEvents, typ string, from, to int) []Node {
 
 	return append(events, more)
 }
+
+// auditPage summarises who looked at hvor, and lists the most recent views.
+func auditPage(summaries []viewerSummary, recent []auditEntry) *Element {
+	cell := func(s string) Node {
+		return Td(a.Props{a.Class: "px-2 py-1"}, Text(s))
+	}
+
+	header := func(names ...string) Node {
+		return Tr(nil, TransformEach(names, func(name string) Node {
+			return Th(a.Props{a.Class: "px-2 py-1 text-left"}, Text(name))
+		})...)
+	}
+
+	return BasePage(
+		nil,
+		Div(
+			a.Props{
+				a.Class: "w-full md:w-2/3 mx-auto px-4 py-6 text-sm text-gray-700",
+			},
+			H2(a.Props{a.Class: "text-2xl md:text-3xl text-gray-600"}, Text("Viewers")),
+			Table(
+				a.Props{a.Class: "mt-4 w-full"},
+				header("Viewer", "Views", "First seen", "Last seen", "Last route", "User agent"),
+				Fragment(TransformEach(summaries, func(vs viewerSummary) Node {
+					return Tr(nil,
+						cell(vs.Viewer),
+						cell(fmt.Sprintf("%d", vs.Views)),
+						cell(vs.First.Format(dateTimeFormat)),
+						cell(vs.Last.Format(dateTimeFormat)),
+						cell(vs.LastRoute),
+						cell(vs.UserAgent),
+					)
+				})...),
+			),
+			H2(a.Props{a.Class: "text-2xl md:text-3xl text-gray-600 mt-12"}, Text("Recent views")),
+			Table(
+				a.Props{a.Class: "mt-4 w-full"},
+				header("Time", "Viewer", "Route", "User agent"),
+				Fragment(TransformEach(recent, func(e auditEntry) Node {
+					return Tr(nil,
+						cell(e.Time.Format(dateTimeFormat)),
+						cell(e.Viewer),
+						cell(e.Route),
+						cell(e.UserAgent),
+					)
+				})...),
+			),
+		),
+	)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/chasefleming/elem-go" //nolint
+)
+
+// liveKeepalive is how often an idle event stream is written to, so
+// proxies do not close it.
+const liveKeepalive = 30 * time.Second
+
+// broadcaster wakes up the live clients when the page is rebuilt.
+// Notifications are coalesced: a slow client only learns that something
+// changed, and renders the latest page when it gets to it.
+type broadcaster struct {
+	mu   sync.Mutex
+	subs map[chan struct{}]struct{}
+}
+
+func (b *broadcaster) subscribe() chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.subs == nil {
+		b.subs = make(map[chan struct{}]struct{})
+	}
+
+	ch := make(chan struct{}, 1)
+	b.subs[ch] = struct{}{}
+
+	return ch
+}
+
+func (b *broadcaster) unsubscribe(ch chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.subs, ch)
+}
+
+func (b *broadcaster) notify() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subs {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// liveFragment renders the current whereabouts as seen by v.
+func (h *hvor) liveFragment(v viewer) string {
+	s := h.snap.Load()
+	if s == nil {
+		return ""
+	}
+
+	return Fragment(currentFragment(s.calPage.restrict(v.scope), h.config().Map.Token)...).Render()
+}
+
+// writeEvent writes a server-sent event; every line of data gets its own
+// data field.
+func writeEvent(w http.ResponseWriter, event, data string) error {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "event: %s\n", event)
+
+	for line := range strings.SplitSeq(data, "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+
+	b.WriteString("\n")
+
+	_, err := w.Write([]byte(b.String()))
+
+	return err
+}
+
+// eventsHandler streams the current whereabouts fragment to the page over
+// SSE whenever it changes, so a wall display stays correct without
+// polling or reloading. The viewer is checked again whenever the stream
+// wakes, and the stream ends when their session or link expires, so a
+// revoked link does not keep a display going.
+func (h *hvor) eventsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v, ok := h.authorise(w, r, accessSession)
+		if !ok {
+			return
+		}
+
+		rc := http.NewResponseController(w)
+
+		// The stream outlives the write timeout of the server.
+		_ = rc.SetWriteDeadline(time.Time{})
+
+		ch := h.live.subscribe()
+		defer h.live.unsubscribe(ch)
+
+		// The page was rendered just before connecting, so only changes
+		// since are sent.
+		last := h.liveFragment(v)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+
+		if err := rc.Flush(); err != nil {
+			h.logf("failed to start event stream: %s", err)
+
+			return
+		}
+
+		keepalive := time.NewTicker(liveKeepalive)
+		defer keepalive.Stop()
+
+		var expired <-chan time.Time
+
+		if !v.expires.IsZero() {
+			timer := time.NewTimer(time.Until(v.expires))
+			defer timer.Stop()
+
+			expired = timer.C
+		}
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-expired:
+				return
+			case <-keepalive.C:
+				if v, ok = h.sessionViewer(r, time.Now()); !ok {
+					return
+				}
+
+				if _, err := w.Write([]byte(": keepalive\n\n")); err != nil {
+					return
+				}
+			case <-ch:
+				if v, ok = h.sessionViewer(r, time.Now()); !ok {
+					return
+				}
+
+				frag := h.liveFragment(v)
+				if frag == last {
+					continue
+				}
+
+				if err := writeEvent(w, "current", frag); err != nil {
+					return
+				}
+
+				last = frag
+			}
+
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	})
+}
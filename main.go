@@ -2,32 +2,46 @@ package main
 
 import (
 	"bytes"
+	"cmp"
 	"context"
+	"crypto/sha256"
 	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"math/rand/v2"
 	"net/http"
 	"os"
 	"os/signal"
 	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
 	ics "github.com/arran4/golang-ical"
 	"github.com/kradalby/kra/web"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"tailscale.com/client/tailscale" //nolint:staticcheck // SA1019: deprecated, pending migration to client/tailscale/v2
 	"tailscale.com/types/logger"
 )
 
 const (
-	defaultHostname = "hvor"
-	refreshPeriod   = 30 * time.Minute
+	defaultHostname      = "hvor"
+	defaultRefreshPeriod = 30 * time.Minute
+	minBackoff           = 30 * time.Second
+
+	propHvorPriority = "X-HVOR-PRIORITY"
+	categoryPrimary  = "hvor-primary"
 )
 
 var (
@@ -36,13 +50,25 @@ var (
 )
 
 var (
+	configPath = flag.String(
+		"config",
+		getEnv("HVOR_CONFIG", ""),
+		"Path to a HuJSON config file of sources, tokens, map, display and refresh settings, overriding their flags and reloaded as it changes",
+	)
+
 	calendarURL = flag.String(
 		"calendar-url",
 		getEnv(
 			"HVOR_CALENDAR_URL",
 			"",
 		),
-		"URL to a shared Calendar in iCal format",
+		"Comma separated list of calendars in iCal format: http(s), webcal or caldav(s) URLs, or paths to local files",
+	)
+
+	caldavCredentialsPath = flag.String(
+		"caldav-credentials-path",
+		getEnv("HVOR_CALDAV_CREDENTIALS_PATH", ""),
+		"Path to credentials for caldav sources, either \"username:password\" or \"Bearer <token>\", unless the config gives others",
 	)
 
 	tailscaleKeyPath = flag.String(
@@ -53,6 +79,12 @@ var (
 
 	hostname = flag.String("ts-hostname", getEnv("HVOR_TS_HOSTNAME", defaultHostname), "")
 
+	tailscalePolicyPath = flag.String(
+		"ts-policy-path",
+		getEnv("HVOR_TS_POLICY_PATH", ""),
+		"Path to a JSON policy of what Tailscale users, tags, nodes and capabilities may see, everyone sees everything if empty",
+	)
+
 	controlURL = flag.String(
 		"ts-controlurl",
 		getEnv("HVOR_TS_CONTROL_SERVER", ""),
@@ -69,20 +101,68 @@ var (
 
 	monthsFuture = flag.Int(
 		"months-future",
-		getEnvInt("HVOR_MONTHS_FUTURE", 3),
+		getEnvInt("HVOR_MONTHS_FUTURE", defaultMonthsFuture),
 		"Months to include in future",
 	)
 
 	monthsPast = flag.Int(
 		"months-past",
-		getEnvInt("HVOR_MONTHS_PAST", 6),
+		getEnvInt("HVOR_MONTHS_PAST", defaultMonthsPast),
 		"Months to include from the past",
 	)
 
 	fromTokensStr = flag.String(
 		"from-tokens",
 		getEnv("HVOR_FROM_TOKENS", ""),
-		"Comma separated list for access and tracking",
+		"Comma separated list for access and tracking, each optionally followed by :scopes, e.g. tok:city+descriptions",
+	)
+
+	tokensPath = flag.String(
+		"tokens-path",
+		getEnv("HVOR_TOKENS_PATH", ""),
+		"Path to a JSON file of access links with labels, scopes, expiry and revocation, reloaded as it changes",
+	)
+
+	shareKeyPath = flag.String(
+		"share-key-path",
+		getEnv("HVOR_SHARE_KEY_PATH", ""),
+		"Path to the key signed share links are verified with, see the mint-link subcommand",
+	)
+
+	sessionDuration = flag.Duration(
+		"session-duration",
+		getEnvDuration("HVOR_SESSION_DURATION", 30*24*time.Hour),
+		"How long a session started from a link lasts",
+	)
+
+	auditLogPath = flag.String(
+		"audit-log",
+		getEnv("HVOR_AUDIT_LOG", ""),
+		"Path to append a log of who viewed hvor to, none if empty",
+	)
+
+	auditLogMaxSize = flag.Int(
+		"audit-log-max-size",
+		getEnvInt("HVOR_AUDIT_LOG_MAX_SIZE", 10),
+		"Size in MB at which the audit log is rotated",
+	)
+
+	auditLogKeep = flag.Int(
+		"audit-log-keep",
+		getEnvInt("HVOR_AUDIT_LOG_KEEP", 5),
+		"Number of rotated audit logs to keep",
+	)
+
+	refreshPeriod = flag.Duration(
+		"refresh-period",
+		getEnvDuration("HVOR_REFRESH_PERIOD", defaultRefreshPeriod),
+		"How often to refresh the calendars",
+	)
+
+	readyRefreshPeriods = flag.Int(
+		"ready-refresh-periods",
+		getEnvInt("HVOR_READY_REFRESH_PERIODS", 3),
+		"Number of refresh periods after the last successful fetch that /readyz reports ready",
 	)
 
 	mapboxToken = flag.String(
@@ -91,6 +171,18 @@ var (
 		"Token for Mapbox API access",
 	)
 
+	icsDescriptions = flag.Bool(
+		"ics-descriptions",
+		getEnvBool("HVOR_ICS_DESCRIPTIONS", false),
+		"Include event descriptions in the /ics feed",
+	)
+
+	stateDir = flag.String(
+		"state-dir",
+		getEnv("HVOR_STATE_DIR", ""),
+		"Directory to keep the last fetched calendar in, served if the calendar is unavailable at startup",
+	)
+
 	dev = flag.Bool(
 		"dev",
 		getEnvBool("HVOR_DEV", false),
@@ -100,40 +192,86 @@ var (
 
 var httpClient = &http.Client{Timeout: 30 * time.Second}
 
-func fetchCalendar(url string) (*ics.Calendar, error) {
-	var body []byte
-	var err error
+// errNotModified is returned by fetchCalendarBody when the calendar has not
+// changed since the fetch the given validators came from.
+var errNotModified = errors.New("calendar not modified")
 
+// validators are the HTTP cache validators of a fetched calendar, sent back
+// on the next fetch so an unchanged calendar is answered with 304 Not
+// Modified instead of the whole body.
+type validators struct {
+	etag         string
+	lastModified string
+}
+
+// fetchCalendarBody downloads the raw iCal data behind url, along with the
+// validators to use for the next fetch.
+func fetchCalendarBody(url string, v validators) ([]byte, validators, error) {
 	if *dev {
-		body, err = os.ReadFile("./cal.dump")
+		body, err := os.ReadFile("./cal.dump")
 		if err != nil {
-			return nil, fmt.Errorf("failed to read cal from disk: %w", err)
+			return nil, v, fmt.Errorf("failed to read cal from disk: %w", err)
 		}
-	} else {
-		resp, err := httpClient.Get(url)
-		if err != nil {
-			return nil, fmt.Errorf("failed to get calendar: %w", err)
-		}
-		defer func() { _ = resp.Body.Close() }()
 
-		if resp.StatusCode != http.StatusOK {
-			return nil, fmt.Errorf("calendar fetch returned status %d", resp.StatusCode)
-		}
+		return body, v, nil
+	}
 
-		body, err = io.ReadAll(resp.Body)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read response body: %w", err)
-		}
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, v, fmt.Errorf("failed to create calendar request: %w", err)
+	}
+
+	if v.etag != "" {
+		req.Header.Set("If-None-Match", v.etag)
+	}
+
+	if v.lastModified != "" {
+		req.Header.Set("If-Modified-Since", v.lastModified)
 	}
 
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, v, fmt.Errorf("failed to get calendar: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, v, errNotModified
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, v, statusError{op: "calendar fetch", code: resp.StatusCode}
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, v, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	return body, validators{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+func parseCalendar(body []byte) (*ics.Calendar, error) {
 	cal, err := ics.ParseCalendar(bytes.NewReader(body))
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse calendar: %w", err)
+		return nil, parseError{err: err}
 	}
 
 	return cal, nil
 }
 
+func fetchCalendar(url string) (*ics.Calendar, error) {
+	body, _, err := fetchCalendarBody(url, validators{})
+	if err != nil {
+		return nil, err
+	}
+
+	return parseCalendar(body)
+}
+
 type pageEvents []pageEvent
 
 func (u pageEvents) Len() int {
@@ -148,18 +286,29 @@ func (u pageEvents) Less(i, j int) bool {
 	return u[i].To.Before(u[j].To)
 }
 
+// pageEvent is a single stay shown on the page. For timed events From and
+// To keep the zone of their TZID, so a flight from Oslo to Tokyo starts in
+// Oslo time and ends in Tokyo time.
 type pageEvent struct {
+	UID         string
 	From        time.Time
 	To          time.Time
+	AllDay      bool
 	Location    *appleLocation
 	Summary     string
 	Description []string
+	Priority    int
 }
 
+// page is what hvor shows. Current is the primary whereabouts when several
+// events span now, the others are kept in Concurrent. Precision is how
+// exact the locations are, as restricted for the viewer.
 type page struct {
-	Current *pageEvent
-	Past    pageEvents
-	Future  pageEvents
+	Current    *pageEvent
+	Concurrent pageEvents
+	Past       pageEvents
+	Future     pageEvents
+	Precision  precision
 }
 
 type appleLocation struct {
@@ -240,68 +389,257 @@ func sanitiseDescription(desc string) []string {
 	return strings.Split(desc, "\\n")
 }
 
-func createPage(cal *ics.Calendar, logf logger.Logf) (*page, error) {
+// newPageEvent builds the page representation of a single VEVENT from
+// its own DTSTART and DTEND, or DURATION.
+func newPageEvent(event *ics.VEvent, tzs timezones) (pageEvent, error) {
+	start := event.GetProperty(ics.ComponentPropertyDtStart)
+	if start == nil {
+		return pageEvent{}, fmt.Errorf("missing start date")
+	}
+
+	from, allDay, err := tzs.parse(start.Value, start.ICalParameters)
+	if err != nil {
+		return pageEvent{}, fmt.Errorf("bad start date: %w", err)
+	}
+
+	var to time.Time
+
+	if end := event.GetProperty(ics.ComponentPropertyDtEnd); end != nil {
+		to, _, err = tzs.parse(end.Value, end.ICalParameters)
+		if err != nil {
+			return pageEvent{}, fmt.Errorf("bad end date: %w", err)
+		}
+	} else if dur := event.GetProperty(ics.ComponentPropertyDuration); dur != nil {
+		days, d, err := parseDuration(dur.Value)
+		if err != nil {
+			return pageEvent{}, fmt.Errorf("bad duration: %w", err)
+		}
+
+		to = from.AddDate(0, 0, days).Add(d)
+	} else if allDay {
+		// An all-day event without an end lasts for the day it starts.
+		to = from.AddDate(0, 0, 1)
+	} else {
+		to = from
+	}
+
+	summary := event.GetProperty(ics.ComponentPropertySummary)
+	desc := event.GetProperty(ics.ComponentPropertyDescription)
+
+	var summaryText string
+	if summary != nil {
+		summaryText = sanitiseCalText(summary.Value)
+	}
+
+	pe := pageEvent{
+		UID:         event.Id(),
+		From:        from,
+		To:          to,
+		AllDay:      allDay,
+		Location:    getAppleLocation(event),
+		Summary:     summaryText,
+		Description: []string{},
+		Priority:    getPriority(event),
+	}
+
+	if desc != nil {
+		pe.Description = sanitiseDescription(sanitiseCalText(desc.Value))
+	}
+
+	return pe, nil
+}
+
+// startingAt returns a copy of the event moved to start, keeping its
+// length. All-day events keep their length in days, timed events their
+// exact duration and the zone of their end.
+func (pe pageEvent) startingAt(start time.Time) pageEvent {
+	if pe.AllDay {
+		days := int(math.Round(pe.To.Sub(pe.From).Hours() / 24))
+
+		pe.From = start
+		pe.To = start.AddDate(0, 0, days)
+
+		return pe
+	}
+
+	d := pe.To.Sub(pe.From)
+
+	pe.From = start
+	pe.To = start.Add(d).In(pe.To.Location())
+
+	return pe
+}
+
+// comparePrecedence orders events spanning the same moment, most relevant
+// first: explicit priority wins, then events with a location, then the
+// shortest, and finally the one that started last. A conference therefore
+// wins over the longer stay it is part of.
+func comparePrecedence(a, b pageEvent) int {
+	if c := cmp.Compare(b.Priority, a.Priority); c != 0 {
+		return c
+	}
+
+	if (a.Location == nil) != (b.Location == nil) {
+		if a.Location != nil {
+			return -1
+		}
+
+		return 1
+	}
+
+	if c := cmp.Compare(a.To.Sub(a.From), b.To.Sub(b.From)); c != 0 {
+		return c
+	}
+
+	if c := b.From.Compare(a.From); c != 0 {
+		return c
+	}
+
+	return strings.Compare(a.Summary, b.Summary)
+}
+
+// getPriority reads the explicit priority of an event, set either with
+// an X-HVOR-PRIORITY integer, higher winning, or by adding the event to
+// the "hvor-primary" category, which counts as priority 1.
+func getPriority(event *ics.VEvent) int {
+	if prop := event.GetProperty(ics.ComponentProperty(propHvorPriority)); prop != nil {
+		if prio, err := strconv.Atoi(strings.TrimSpace(prop.Value)); err == nil {
+			return prio
+		}
+	}
+
+	for _, prop := range event.GetProperties(ics.ComponentPropertyCategories) {
+		for _, cat := range strings.Split(prop.Value, ",") {
+			if strings.EqualFold(strings.TrimSpace(cat), categoryPrimary) {
+				return 1
+			}
+		}
+	}
+
+	return 0
+}
+
+func isCancelled(event *ics.VEvent) bool {
+	status := event.GetProperty(ics.ComponentPropertyStatus)
+
+	return status != nil && strings.EqualFold(status.Value, string(ics.ObjectStatusCancelled))
+}
+
+func createPage(cal *ics.Calendar, w window, logf logger.Logf) (*page, error) {
 	now := time.Now()
-	pastCutoff := now.AddDate(0, -*monthsPast, 0)
-	futureCutoff := now.AddDate(0, *monthsFuture, 0)
+	pastCutoff, futureCutoff := w.bounds(now)
 
 	p := page{
 		Past:   make(pageEvents, 0),
 		Future: make(pageEvents, 0),
 	}
 
-	for _, event := range cal.Events() {
-		from, err := event.GetAllDayStartAt()
-		if err != nil {
-			logf("skipping event (bad start date): %s", err)
+	var current pageEvents
 
-			continue
+	add := func(pe pageEvent) {
+		if pe.To.Before(now) {
+			if pe.To.After(pastCutoff) {
+				p.Past = append(p.Past, pe)
+			}
+
+			return
 		}
 
-		to, err := event.GetAllDayEndAt()
-		if err != nil {
-			logf("skipping event (bad end date): %s", err)
+		if pe.From.After(now) {
+			if pe.From.Before(futureCutoff) {
+				p.Future = append(p.Future, pe)
+			}
+
+			return
+		}
+
+		current = append(current, pe)
+	}
+
+	tzs := calendarTimezones(cal)
+	events := cal.Events()
+	overrides := recurrenceOverrides(events, tzs)
 
+	for _, event := range events {
+		if event.HasProperty(ics.ComponentPropertyRecurrenceId) {
+			// Overrides are placed when expanding their recurring event.
 			continue
 		}
 
-		summary := event.GetProperty(ics.ComponentPropertySummary)
-		desc := event.GetProperty(ics.ComponentPropertyDescription)
+		pe, err := newPageEvent(event, tzs)
+		if err != nil {
+			logf("skipping event: %s", err)
 
-		var summaryText string
-		if summary != nil {
-			summaryText = sanitiseCalText(summary.Value)
+			continue
 		}
 
-		pe := pageEvent{
-			From:        from,
-			To:          to,
-			Location:    getAppleLocation(event),
-			Summary:     summaryText,
-			Description: []string{},
+		rec, err := getRecurrence(event, tzs, pe.AllDay)
+		if err != nil {
+			logf("ignoring recurrence of event %q: %s", pe.Summary, err)
 		}
 
-		if desc != nil {
-			pe.Description = sanitiseDescription(sanitiseCalText(desc.Value))
+		if rec == nil {
+			add(pe)
+
+			continue
 		}
 
-		if to.Before(now) {
-			if to.After(pastCutoff) {
-				p.Past = append(p.Past, pe)
+		instances := overrides[event.Id()]
+		delete(overrides, event.Id())
+
+		for _, start := range rec.occurrences(pe.From, futureCutoff) {
+			key := occurrenceKey(start, rec.allDay)
+
+			override, ok := instances[key]
+			if !ok {
+				add(pe.startingAt(start))
+
+				continue
 			}
 
-			continue
+			delete(instances, key)
+
+			if isCancelled(override) {
+				continue
+			}
+
+			ope, err := newPageEvent(override, tzs)
+			if err != nil {
+				logf("skipping recurrence override: %s", err)
+
+				continue
+			}
+
+			add(ope)
 		}
 
-		if from.After(now) {
-			if from.Before(futureCutoff) {
-				p.Future = append(p.Future, pe)
+		// Overrides of instances that are not generated by the rule
+		// still exist on their own.
+		overrides[event.Id()] = instances
+	}
+
+	for _, instances := range overrides {
+		for _, override := range instances {
+			if isCancelled(override) {
+				continue
 			}
 
-			continue
+			ope, err := newPageEvent(override, tzs)
+			if err != nil {
+				logf("skipping recurrence override: %s", err)
+
+				continue
+			}
+
+			add(ope)
 		}
+	}
 
-		p.Current = &pe
+	if len(current) > 0 {
+		slices.SortFunc(current, comparePrecedence)
+
+		p.Current = &current[0]
+		p.Concurrent = current[1:]
 	}
 
 	sort.Sort(sort.Reverse(p.Past))
@@ -310,91 +648,461 @@ func createPage(cal *ics.Calendar, logf logger.Logf) (*page, error) {
 	return &p, nil
 }
 
+// tokens maps the from tokens to the scope they grant.
 type tokens struct {
-	ts []string
+	ts map[string]scope
 }
 
+// parseTokens parses a comma separated list of tokens, each optionally
+// followed by ":" and its scopes, for example "abc,def:city+descriptions".
+// A token without scopes sees everything. Tokens with invalid scopes are
+// skipped.
 func parseTokens(str string) tokens {
 	if str == "" {
 		return tokens{}
 	}
 
-	list := strings.Split(str, ",")
+	ts := make(map[string]scope)
+
+	for _, entry := range strings.Split(str, ",") {
+		tok, scopes, ok := strings.Cut(entry, ":")
+		if !ok {
+			ts[tok] = fullScope
+
+			continue
+		}
+
+		sc, err := parseScope(scopes)
+		if err != nil {
+			log.Printf("skipping from token with invalid scope: %s", err)
+
+			continue
+		}
+
+		ts[tok] = sc
+	}
 
 	return tokens{
-		ts: list,
+		ts: ts,
 	}
 }
 
 func (t *tokens) isValid(token string) bool {
-	for _, tok := range t.ts {
-		if tok == token {
-			return true
-		}
+	_, ok := t.scope(token)
+
+	return ok
+}
+
+// scope returns the scope granted by token, if it is valid.
+func (t *tokens) scope(token string) (scope, bool) {
+	if token == "" {
+		return scope{}, false
 	}
 
-	return false
+	sc, ok := t.ts[token]
+
+	return sc, ok
 }
 
 // snapshot bundles the calendar page and fetch time for atomic swapping.
+// The data of every source is kept so the page can be rebuilt while
+// sources are unavailable; if all of them are, the snapshot is marked
+// stale.
 type snapshot struct {
 	calPage   *page
 	lastFetch time.Time
+	calendars []sourceCalendar
+	stale     bool
+	hash      [sha256.Size]byte
+
+	// expires is when calPage needs rebuilding even if the calendars
+	// have not changed.
+	expires time.Time
+
+	// window is what calPage was built for, and built when.
+	window window
+	built  time.Time
+}
+
+// freshness summarises how up to date the snapshot is, for the page
+// footer.
+func (s *snapshot) freshness() freshness {
+	f := freshness{
+		lastFetch: s.lastFetch,
+		stale:     s.stale,
+		sources:   len(s.calendars),
+	}
+
+	for _, sc := range s.calendars {
+		if sc.err != nil {
+			f.unavailable++
+		}
+	}
+
+	return f
+}
+
+func (s *snapshot) health() []sourceHealth {
+	ret := make([]sourceHealth, 0, len(s.calendars))
+	for _, sc := range s.calendars {
+		ret = append(ret, sc.health())
+	}
+
+	return ret
 }
 
 type hvor struct {
-	url         string
-	tokens      tokens
-	snap        atomic.Pointer[snapshot]
-	mapboxToken string
-	tsLocal     *tailscale.LocalClient //nolint:staticcheck // SA1019: deprecated, pending migration to client/tailscale/v2
-	logf        logger.Logf
+	conf          atomic.Pointer[config]
+	configPath    string
+	baseConfig    config
+	configStat    atomic.Pointer[fileStat]
+	stateDir      string
+	tokenStore    *tokenStore
+	shareKey      []byte
+	tsPolicy      *tsPolicy
+	sessionKey    []byte
+	audit         *auditLog
+	webhooks      *webhookQueue
+	lastUpdateErr atomic.Pointer[updateError]
+	refresh       chan struct{}
+	live          broadcaster
+	sessionOnce   sync.Once
+	snap          atomic.Pointer[snapshot]
+	tsLocal       *tailscale.LocalClient //nolint:staticcheck // SA1019: deprecated, pending migration to client/tailscale/v2
+	logf          logger.Logf
+}
+
+// backoff returns how long to wait before retrying after the given number
+// of consecutive failed updates. It doubles from minBackoff up to period,
+// and half of it is random so restarted instances do not retry in
+// lockstep.
+func backoff(failures int, period time.Duration) time.Duration {
+	d := minBackoff
+	for i := 1; i < failures && d < period; i++ {
+		d *= 2
+	}
+
+	d = min(d, period)
+
+	return d/2 + rand.N(d/2+1)
+}
+
+// period returns how often the calendars are refreshed.
+func (h *hvor) period() time.Duration {
+	return cmp.Or(time.Duration(h.config().Refresh.Period), defaultRefreshPeriod)
+}
+
+// triggerRefresh asks the updater to refresh now. Triggers arriving while
+// a refresh is pending are coalesced into it.
+func (h *hvor) triggerRefresh() {
+	select {
+	case h.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// firstUpdate returns the failures and wait the updater starts with. When
+// startup served a snapshot or nothing, the initial fetch failed, so it is
+// retried on the backoff schedule rather than after a whole period.
+func (h *hvor) firstUpdate() (int, time.Duration) {
+	if s := h.snap.Load(); s != nil && !s.stale {
+		return 0, h.period()
+	}
+
+	return 1, backoff(1, h.period())
 }
 
 func (h *hvor) updater(ctx context.Context) {
-	ticker := time.NewTicker(refreshPeriod)
-	defer ticker.Stop()
+	failures, wait := h.firstUpdate()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
-			if err := h.updateCalendar(); err != nil {
-				h.logf("failed to update calendar data: %s", err)
+		case <-timer.C:
+		case <-h.refresh:
+			timer.Stop()
+		}
+
+		wait := h.period()
+
+		if err := h.updateCalendar(); err != nil {
+			failures++
+			wait = backoff(failures, h.period())
+
+			h.logf("failed to update calendar data, retrying in %s: %s", wait.Round(time.Second), err)
+			h.markStale()
+		} else {
+			failures = 0
+		}
+
+		timer.Reset(wait)
+	}
+}
+
+// updateCalendar fetches all sources concurrently and swaps in a page
+// merged from them. Sources that fail keep their last known data; only if
+// every source fails is an error returned.
+func (h *hvor) updateCalendar() (err error) {
+	defer func() { h.recordUpdate(err) }()
+
+	prev := h.snap.Load()
+	now := time.Now()
+	cfg := h.config()
+	w := cfg.window()
+
+	cals := make([]sourceCalendar, len(cfg.Sources))
+
+	var wg sync.WaitGroup
+
+	for i, src := range cfg.Sources {
+		sc := sourceCalendar{url: src}
+		if prev != nil {
+			if known := prev.calendar(src); known != nil {
+				sc = *known
 			}
 		}
+
+		wg.Go(func() {
+			cals[i] = sc.fetch(now, w, cfg.CalDAVCredentials, cfg.person.ID, sourceLabel(i, src))
+		})
+	}
+
+	wg.Wait()
+
+	var errs []error
+
+	for _, sc := range cals {
+		if sc.err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", redactSource(sc.url), sc.err))
+		}
+	}
+
+	if len(errs) == len(cals) {
+		return errors.Join(errs...)
+	}
+
+	for _, err := range errs {
+		h.logf("failed to update calendar source, keeping its last known data: %s", err)
+	}
+
+	next := snapshot{
+		lastFetch: now,
+		calendars: cals,
+	}
+
+	if prev != nil && prev.hash == calendarsHash(cals) && prev.window == w && now.Before(prev.expires) {
+		// Unchanged calendars, the page is still accurate.
+		next.calPage = prev.calPage
+		next.hash = prev.hash
+		next.expires = prev.expires
+		next.window = prev.window
+		next.built = prev.built
+		h.snap.Store(&next)
+	} else if err := h.setCalendar(next); err != nil {
+		return err
+	}
+
+	lastUpdate.WithLabelValues(cfg.person.ID).Set(float64(now.Unix()))
+
+	if h.stateDir != "" {
+		if err := saveSnapshot(h.stateDir, cals, now); err != nil {
+			h.logf("failed to persist calendar snapshot: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// calendar returns the state of the given source, if known.
+func (s *snapshot) calendar(src string) *sourceCalendar {
+	for i := range s.calendars {
+		if s.calendars[i].url == src {
+			return &s.calendars[i]
+		}
 	}
+
+	return nil
 }
 
-func (h *hvor) updateCalendar() error {
-	cal, err := fetchCalendar(h.url)
+// setCalendar builds the page from the calendars of s and swaps it in.
+func (h *hvor) setCalendar(s snapshot) error {
+	parsed := make([]*ics.Calendar, 0, len(s.calendars))
+	for _, sc := range s.calendars {
+		parsed = append(parsed, sc.cal)
+	}
+
+	w := h.config().window()
+	now := time.Now()
+
+	p, err := createPage(mergeCalendars(parsed), w, h.logf)
 	if err != nil {
 		return err
 	}
 
-	p, err := createPage(cal, h.logf)
+	observePage(h.config().person.ID, p)
+
+	s.calPage = p
+	s.hash = calendarsHash(s.calendars)
+	s.expires = pageExpiry(p, now)
+	s.window = w
+	s.built = now
+
+	prev := h.snap.Swap(&s)
+	h.live.notify()
+	h.notifyChanges(prev, &s)
+
+	return nil
+}
+
+// pageExpiry returns when a page built at now needs rebuilding: when a
+// current event ends or the next one starts, and at the latest after a
+// day so the past and future windows keep sliding.
+func pageExpiry(p *page, now time.Time) time.Time {
+	exp := now.Add(24 * time.Hour)
+
+	consider := func(t time.Time) {
+		if t.After(now) && t.Before(exp) {
+			exp = t
+		}
+	}
+
+	if p.Current != nil {
+		consider(p.Current.To)
+	}
+
+	for _, pe := range p.Concurrent {
+		consider(pe.To)
+	}
+
+	for _, pe := range p.Future {
+		consider(pe.From)
+	}
+
+	return exp
+}
+
+// restoreSnapshot serves the calendars persisted in the state directory,
+// marked as stale until the next successful fetch.
+func (h *hvor) restoreSnapshot() error {
+	if h.stateDir == "" {
+		return fmt.Errorf("no state directory configured")
+	}
+
+	stored, err := loadSnapshot(h.stateDir)
 	if err != nil {
 		return err
 	}
 
-	h.snap.Store(&snapshot{calPage: p, lastFetch: time.Now()})
+	sources := h.config().Sources
+	cals := make([]sourceCalendar, 0, len(sources))
+	restored := 0
 
-	return nil
+	for _, src := range sources {
+		sc := sourceCalendar{url: src}
+
+		if sd, ok := stored.Calendars[src]; ok {
+			cal, err := parseCalendar([]byte(sd.Calendar))
+			if err != nil {
+				return fmt.Errorf("%s: %w", redactSource(src), err)
+			}
+
+			sc.raw = []byte(sd.Calendar)
+			sc.cal = cal
+			sc.lastFetch = sd.LastFetch
+			restored++
+		}
+
+		cals = append(cals, sc)
+	}
+
+	if restored == 0 {
+		return fmt.Errorf("snapshot has none of the configured sources")
+	}
+
+	return h.setCalendar(snapshot{
+		lastFetch: stored.LastFetch,
+		calendars: cals,
+		stale:     true,
+	})
+}
+
+// markStale flags the current snapshot as stale after a failed update,
+// rebuilding its page if it has expired so past and current keep moving
+// with time.
+func (h *hvor) markStale() {
+	s := h.snap.Load()
+	if s == nil {
+		return
+	}
+
+	next := *s
+	next.stale = true
+
+	if time.Now().Before(s.expires) {
+		h.snap.Store(&next)
+
+		return
+	}
+
+	if err := h.setCalendar(next); err != nil {
+		h.logf("failed to rebuild stale calendar data: %s", err)
+	}
+}
+
+// refreshHandler refreshes the calendars now on POST, for scripts and
+// webhooks. It needs the full scope, so links shared with others cannot
+// be used for it.
+func (h *hvor) refreshHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		if !h.authoriseFull(w, r) {
+			return
+		}
+
+		h.triggerRefresh()
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
+
+// sourcesHandler reports the health of every calendar source.
+func (h *hvor) sourcesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		s := h.snap.Load()
+		if s == nil {
+			http.Error(w, "no calendar data yet", http.StatusServiceUnavailable)
+
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(s.health())
+	})
 }
 
-func (h *hvor) isViaTailscale(r *http.Request) bool {
+// tailscaleViewer returns who is behind a request coming over Tailscale.
+// Without a policy every peer sees everything.
+func (h *hvor) tailscaleViewer(r *http.Request) (viewer, bool) {
 	if h.tsLocal == nil {
 		h.logf("no tailscale client is available, connection not coming from tailscale")
 
-		return false
+		return viewer{}, false
 	}
 
 	who, err := h.tsLocal.WhoIs(r.Context(), r.RemoteAddr)
 	if err != nil {
 		h.logf("failed to find out who connected with tailscale: %s", err)
 
-		return false
+		return viewer{}, false
 	}
 
 	displayName := "Unknown User"
@@ -403,24 +1111,178 @@ func (h *hvor) isViaTailscale(r *http.Request) bool {
 	}
 	h.logf("tailscale who: %s", displayName)
 
+	v := viewer{scope: fullScope, label: tailscaleLabel(who)}
+
+	if h.tsPolicy != nil {
+		sc, ok := h.tsPolicy.scope(newTSIdentity(who))
+		if !ok {
+			h.logf("tailscale policy denies %s", displayName)
+
+			return viewer{}, false
+		}
+
+		v.scope = sc
+	}
+
+	return v, true
+}
+
+// accessMode is how a route accepts from tokens.
+type accessMode int
+
+const (
+	// accessPage exchanges a from token for a session cookie and
+	// redirects to the URL without it.
+	accessPage accessMode = iota
+	// accessSession only accepts a session or Tailscale, for the requests
+	// made by the page.
+	accessSession
+	// accessToken accepts a from token on every request, for feeds and
+	// APIs whose clients cannot keep cookies.
+	accessToken
+)
+
+var (
+	errUnknownToken = errors.New("unknown token")
+	errOtherPerson  = errors.New("token is for someone else")
+)
+
+// tokenViewer returns who a from token was given to: a configured token,
+// one from the token store, or a signed share link. Links for another
+// person of the team are refused with errOtherPerson.
+func (h *hvor) tokenViewer(token string, now time.Time) (viewer, error) {
+	cfg := h.config()
+
+	if sc, ok := cfg.tokens.scope(token); ok {
+		return viewer{scope: sc, label: tokenLabel(token)}, nil
+	}
+
+	if h.tokenStore != nil {
+		if st, ok := h.tokenStore.lookup(token, now); ok {
+			if !cfg.person.allows(st.Person) {
+				return viewer{}, errOtherPerson
+			}
+
+			v := viewer{scope: st.scope, label: cmp.Or(st.Label, tokenLabel(token))}
+
+			return v.until(st.Expires).until(st.ValidUntil), nil
+		}
+	}
+
+	if h.shareKey != nil {
+		if link, err := verifyShareLink(h.shareKey, token, now); err == nil {
+			if !cfg.person.allows(link.Person) {
+				return viewer{}, errOtherPerson
+			}
+
+			return viewer{scope: link.scope, label: link.Label, expires: time.Unix(link.Expires, 0)}, nil
+		}
+	}
+
+	return viewer{}, errUnknownToken
+}
+
+// tokenLabel names the viewer of a token without a label in the audit log
+// and metrics, which must not give the token away.
+func tokenLabel(token string) string {
+	sum := sha256.Sum256([]byte(token))
+
+	return "token-" + hex.EncodeToString(sum[:4])
+}
+
+// authorise returns who is behind a request coming over Tailscale, with a
+// valid session, or, as mode allows, a valid from token, and records the
+// view. It writes an Unauthorised response, or the redirect after starting
+// a session, if the request is not to be served.
+func (h *hvor) authorise(w http.ResponseWriter, r *http.Request, mode accessMode) (viewer, bool) {
+	v, ok := h.viewer(w, r, mode)
+	if ok {
+		h.recordView(r, v)
+	}
+
+	return v, ok
+}
+
+// sessionViewer returns who is behind a request coming over Tailscale or
+// with a valid session, without writing a response, so long-lived requests
+// can check again that they may still be served.
+func (h *hvor) sessionViewer(r *http.Request, now time.Time) (viewer, bool) {
+	if v, ok := h.tailscaleViewer(r); ok {
+		return v, true
+	}
+
+	token, expires, ok := h.sessionToken(r, now)
+	if !ok {
+		return viewer{}, false
+	}
+
+	v, err := h.tokenViewer(token, now)
+	if err != nil {
+		return viewer{}, false
+	}
+
+	return v.until(expires), true
+}
+
+// authoriseFull is authorise for what links shared with others must not
+// reach, answering Forbidden to anything less than the full scope.
+func (h *hvor) authoriseFull(w http.ResponseWriter, r *http.Request) bool {
+	v, ok := h.authorise(w, r, accessToken)
+	if !ok {
+		return false
+	}
+
+	if v.scope != fullScope {
+		http.Error(w, "forbidden", http.StatusForbidden)
+
+		return false
+	}
+
 	return true
 }
 
+func (h *hvor) viewer(w http.ResponseWriter, r *http.Request, mode accessMode) (viewer, bool) {
+	now := time.Now()
+
+	if v, ok := h.sessionViewer(r, now); ok {
+		return v, true
+	}
+
+	if from := r.URL.Query().Get("from"); mode != accessSession && from != "" {
+		v, err := h.tokenViewer(from, now)
+
+		switch {
+		case errors.Is(err, errOtherPerson):
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("Forbidden, this link is for someone else"))
+
+			return viewer{}, false
+		case err == nil && mode == accessToken:
+			return v, true
+		case err == nil:
+			http.SetCookie(w, h.sessionCookieFor(r, from, now))
+			http.Redirect(w, r, withoutFrom(r), http.StatusSeeOther)
+
+			return viewer{}, false
+		}
+	}
+
+	w.WriteHeader(http.StatusUnauthorized)
+	_, _ = w.Write([]byte("Unauthorised, you probably do not have a direct link"))
+
+	return viewer{}, false
+}
+
 func (h *hvor) handler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		from := r.URL.Query().Get("from")
-		if !h.isViaTailscale(r) && !h.tokens.isValid(from) {
-			w.WriteHeader(http.StatusUnauthorized)
-			_, _ = w.Write([]byte("Unauthorised, you probably do not have a direct link"))
-
+		v, ok := h.authorise(w, r, accessPage)
+		if !ok {
 			return
 		}
 
-		// TODO(kradalby): use from for metrics
-
 		s := h.snap.Load()
 		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte(hvorPage(s.calPage, h.mapboxToken, s.lastFetch).Render()))
+		_, _ = w.Write([]byte(hvorPage(s.calPage.restrict(v.scope), h.config().person, h.nearby(v), h.config().Map.Token, s.freshness()).Render()))
 	})
 }
 
@@ -450,13 +1312,18 @@ func pager(w http.ResponseWriter, r *http.Request) (int, int, error) {
 
 func (h *hvor) future() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v, ok := h.authorise(w, r, accessSession)
+		if !ok {
+			return
+		}
+
 		from, to, err := pager(w, r)
 		if err != nil {
 			return
 		}
 
 		s := h.snap.Load()
-		evs := events(s.calPage.Future, "future", from, to)
+		evs := events(s.calPage.restrict(v.scope).Future, h.config().person.base(), "future", from, to)
 
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte(renderNodeList(evs)))
@@ -465,13 +1332,18 @@ func (h *hvor) future() http.Handler {
 
 func (h *hvor) past() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v, ok := h.authorise(w, r, accessSession)
+		if !ok {
+			return
+		}
+
 		from, to, err := pager(w, r)
 		if err != nil {
 			return
 		}
 
 		s := h.snap.Load()
-		evs := events(s.calPage.Past, "past", from, to)
+		evs := events(s.calPage.restrict(v.scope).Past, h.config().person.base(), "past", from, to)
 
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte(renderNodeList(evs)))
@@ -482,9 +1354,15 @@ func (h *hvor) past() http.Handler {
 var staticAssets embed.FS
 
 func main() {
-	flag.Parse()
+	if len(os.Args) > 1 && os.Args[1] == "mint-link" {
+		if err := mintLinkCommand(os.Args[2:], os.Stdout); err != nil {
+			log.Fatalf("Failed to mint share link: %s", err)
+		}
 
-	toks := parseTokens(*fromTokensStr)
+		return
+	}
+
+	flag.Parse()
 
 	logger := log.New(os.Stdout, "hvor: ", log.LstdFlags)
 
@@ -504,14 +1382,57 @@ func main() {
 	}
 
 	h := hvor{
-		url:         *calendarURL,
-		tokens:      toks,
-		mapboxToken: *mapboxToken,
-		logf:        logger.Printf,
+		configPath: *configPath,
+		baseConfig: flagConfig(),
+		stateDir:   *stateDir,
+		refresh:    make(chan struct{}, 1),
+		logf:       logger.Printf,
+	}
+
+	if h.configPath == "" {
+		if err := h.baseConfig.validate(); err != nil {
+			log.Fatalf("Invalid configuration: %s", err)
+		}
+
+		h.conf.Store(&h.baseConfig)
+	} else if err := h.reloadConfig(); err != nil {
+		log.Fatalf("Failed to load config: %s", err)
+	}
+
+	if *tokensPath != "" {
+		store, err := newTokenStore(*tokensPath, logger.Printf)
+		if err != nil {
+			log.Fatalf("Failed to load token store: %s", err)
+		}
+
+		h.tokenStore = store
 	}
 
-	if err := h.updateCalendar(); err != nil {
-		log.Fatalf("Failed to get initial calendar: %s", err)
+	if *shareKeyPath != "" {
+		key, err := loadShareKey(*shareKeyPath)
+		if err != nil {
+			log.Fatalf("Failed to load share key: %s", err)
+		}
+
+		h.shareKey = key
+	}
+
+	if *tailscalePolicyPath != "" {
+		policy, err := loadTSPolicy(*tailscalePolicyPath)
+		if err != nil {
+			log.Fatalf("Failed to load tailscale policy: %s", err)
+		}
+
+		h.tsPolicy = policy
+	}
+
+	if *auditLogPath != "" {
+		audit, err := openAuditLog(*auditLogPath, int64(*auditLogMaxSize)<<20, *auditLogKeep)
+		if err != nil {
+			log.Fatalf("Failed to open audit log: %s", err)
+		}
+
+		h.audit = audit
 	}
 
 	if localClient := k.TailscaleLocalClient(); localClient != nil {
@@ -521,17 +1442,86 @@ func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
-	logger.Printf("starting background updater of calendar data, running every %s", refreshPeriod)
+	h.webhooks = newWebhookQueue(ctx, logger.Printf)
 
-	go h.updater(ctx)
+	// With people in the config, one instance serves the whole team;
+	// otherwise it serves one person at the root.
+	var (
+		t         *team
+		reloaded  = h.triggerRefresh
+		sources   = h.sourcesHandler()
+		readiness = h.readinessHandler()
+	)
+
+	if len(h.config().People) > 0 {
+		t = newTeam(&h)
+		reloaded = func() { t.sync(ctx) }
+		sources = t.sourcesHandler()
+		readiness = t.readinessHandler()
+
+		logger.Printf("starting background updaters of calendar data for %d people, running every %s", len(h.config().People), h.period())
+		t.sync(ctx)
+	} else {
+		if err := h.loadInitial(); err != nil {
+			log.Fatalf("Failed to start: %s", err)
+		}
+
+		logger.Printf("starting background updater of calendar data, running every %s", h.period())
+
+		go h.updater(ctx)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			logger.Printf("received SIGHUP, reloading config and refreshing calendar data")
+
+			if err := h.reloadConfig(); err != nil {
+				logger.Printf("failed to reload config, keeping the config in use: %s", err)
+			}
+
+			reloaded()
+		}
+	}()
+
+	if h.tokenStore != nil {
+		go h.tokenStore.watch(ctx)
+	}
+
+	if h.configPath != "" {
+		go h.watchConfig(ctx, reloaded)
+	}
+
+	people := func() []*hvor { return []*hvor{&h} }
+	if t != nil {
+		people = t.people
+	}
+
+	go h.watchColocations(ctx, people)
 
 	staticFS := http.FS(staticAssets)
 	fs := http.FileServer(staticFS)
 	k.Handle("/static/", fs)
 
-	k.Handle("/", h.handler())
-	k.Handle("/future", h.future())
-	k.Handle("/past", h.past())
+	// Over Tailscale, kra serves the metrics itself.
+	if debug := k.DebugHandler(); debug == nil {
+		k.Handle("/metrics", promhttp.Handler())
+	} else {
+		debug.Handle("sources", "Calendar sources", sources)
+		debug.Handle("readiness", "Readiness in detail", readiness)
+	}
+
+	k.Handle("/healthz", h.healthzHandler())
+
+	if t != nil {
+		k.Handle("/readyz", t.readyzHandler())
+		k.Handle("/", t)
+	} else {
+		k.Handle("/audit", instrument("audit", h.auditHandler()))
+		h.handle(k)
+	}
 
 	log.Fatalf("Failed to serve %s", k.ListenAndServe(ctx))
 }
@@ -1,21 +1,46 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	ics "github.com/arran4/golang-ical"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
 )
 
 // ============================================================
 // Test helpers
 // ============================================================
 
+// testHvor returns a hvor using cfg.
+func testHvor(t *testing.T, cfg config) *hvor {
+	t.Helper()
+
+	h := &hvor{logf: t.Logf}
+	h.conf.Store(&cfg)
+
+	return h
+}
+
 // makePageEvents creates n dummy pageEvents with sequential weekly dates.
 func makePageEvents(n int) pageEvents {
 	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
@@ -288,7 +313,7 @@ func TestCreatePageSorting(t *testing.T) {
 	addAllDayEvent(cal, "future-far", now.AddDate(0, 2, 15), now.AddDate(0, 2, 16), "Future Far")
 	addAllDayEvent(cal, "future-soon", now.AddDate(0, 1, 0), now.AddDate(0, 1, 1), "Future Soon")
 
-	p, err := createPage(cal, t.Logf)
+	p, err := createPage(cal, defaultWindow, t.Logf)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -346,7 +371,7 @@ func TestCreatePageWithDescription(t *testing.T) {
 	ev2.SetAllDayEndAt(now.AddDate(0, -2, 1))
 	ev2.SetSummary("No Desc")
 
-	p, err := createPage(cal, t.Logf)
+	p, err := createPage(cal, defaultWindow, t.Logf)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -377,7 +402,7 @@ func TestEventsClampTo(t *testing.T) {
 	es := makePageEvents(3)
 
 	// to=999 exceeds len(es)=3, should be clamped without panic.
-	result := events(es, "future", 0, 999)
+	result := events(es, "", "future", 0, 999)
 	if len(result) < 3 {
 		t.Errorf("expected at least 3 results, got %d", len(result))
 	}
@@ -385,13 +410,13 @@ func TestEventsClampTo(t *testing.T) {
 
 func TestEventsEmptySlice(t *testing.T) {
 	// nil slice should not panic.
-	result := events(nil, "future", 0, 5)
+	result := events(nil, "", "future", 0, 5)
 	if result == nil {
 		t.Error("expected non-nil result for nil input")
 	}
 
 	// Empty slice should not panic.
-	result = events(pageEvents{}, "past", 0, 5)
+	result = events(pageEvents{}, "", "past", 0, 5)
 	if result == nil {
 		t.Error("expected non-nil result for empty input")
 	}
@@ -450,7 +475,7 @@ func TestCreatePageNilSummary(t *testing.T) {
 	ev.SetAllDayEndAt(now.AddDate(0, -1, 1))
 	// Intentionally no SetSummary.
 
-	p, err := createPage(cal, t.Logf)
+	p, err := createPage(cal, defaultWindow, t.Logf)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -464,7 +489,7 @@ func TestEventsNegativeFrom(t *testing.T) {
 	es := makePageEvents(5)
 
 	// Should not panic — from should be clamped to 0.
-	result := events(es, "future", -1, 5)
+	result := events(es, "", "future", -1, 5)
 	if len(result) < 1 {
 		t.Error("expected non-empty result")
 	}
@@ -474,14 +499,14 @@ func TestEventsFromExceedsLen(t *testing.T) {
 	es := makePageEvents(3)
 
 	// Should not panic — should return empty or clamped result.
-	_ = events(es, "future", 999, 1000)
+	_ = events(es, "", "future", 999, 1000)
 }
 
 func TestEventsFromGreaterThanTo(t *testing.T) {
 	es := makePageEvents(10)
 
 	// Should not panic — should return empty or clamped result.
-	_ = events(es, "future", 7, 5)
+	_ = events(es, "", "future", 7, 5)
 }
 
 func TestPagerInvalidFromValidTo(t *testing.T) {
@@ -572,7 +597,7 @@ func TestHvorConcurrentAccess(t *testing.T) {
 	addAllDayEvent(cal, "e2", now.AddDate(0, -1, 0), now.AddDate(0, -1, 1), "Past")
 	addAllDayEvent(cal, "e3", now.AddDate(0, 1, 0), now.AddDate(0, 1, 1), "Future")
 
-	p, err := createPage(cal, t.Logf)
+	p, err := createPage(cal, defaultWindow, t.Logf)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -623,3 +648,3902 @@ func TestHvorConcurrentAccess(t *testing.T) {
 
 	wg.Wait()
 }
+
+// ============================================================
+// Recurrence
+// ============================================================
+
+func TestExpandRule(t *testing.T) {
+	dtstart := time.Date(2025, 1, 6, 0, 0, 0, 0, time.UTC) // Monday
+	windowEnd := time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		rule string
+		want []string
+	}{
+		{
+			rule: "FREQ=WEEKLY;INTERVAL=2;COUNT=4",
+			want: []string{"20250106", "20250120", "20250203", "20250217"},
+		},
+		{
+			rule: "FREQ=WEEKLY;BYDAY=MO,TH;UNTIL=20250116",
+			want: []string{"20250106", "20250109", "20250113", "20250116"},
+		},
+		{
+			rule: "FREQ=MONTHLY;BYDAY=-1FR",
+			want: []string{"20250131", "20250228", "20250328"},
+		},
+		{
+			rule: "FREQ=MONTHLY;BYMONTHDAY=6,-1",
+			want: []string{"20250106", "20250131", "20250206", "20250228", "20250306", "20250331"},
+		},
+		{
+			rule: "FREQ=DAILY;INTERVAL=10;BYMONTH=2",
+			want: []string{"20250205", "20250215", "20250225"},
+		},
+		{
+			rule: "FREQ=MONTHLY;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=1;COUNT=3",
+			want: []string{"20250203", "20250303"},
+		},
+	}
+
+	for _, tt := range tests {
+		rule, err := ics.ParseRecurrenceRule(tt.rule)
+		if err != nil {
+			t.Fatalf("parsing %q: %s", tt.rule, err)
+		}
+
+		var got []string
+		for _, occ := range expandRule(rule, dtstart, windowEnd) {
+			got = append(got, occ.Format("20060102"))
+		}
+
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("expandRule(%q) = %v, want %v", tt.rule, got, tt.want)
+		}
+	}
+}
+
+func TestExpandRuleSkipsMissingDays(t *testing.T) {
+	dtstart := time.Date(2025, 1, 31, 0, 0, 0, 0, time.UTC)
+	windowEnd := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	rule, err := ics.ParseRecurrenceRule("FREQ=MONTHLY")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, occ := range expandRule(rule, dtstart, windowEnd) {
+		got = append(got, occ.Format("20060102"))
+	}
+
+	want := []string{"20250131", "20250331", "20250531"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expandRule = %v, want %v", got, want)
+	}
+}
+
+func TestRecurrenceOccurrences(t *testing.T) {
+	dtstart := time.Date(2025, 1, 6, 0, 0, 0, 0, time.UTC)
+	rule, err := ics.ParseRecurrenceRule("FREQ=WEEKLY;COUNT=4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &recurrence{
+		rrules:  []*ics.RecurrenceRule{rule},
+		rdates:  []time.Time{time.Date(2025, 1, 8, 0, 0, 0, 0, time.UTC)},
+		exdates: []time.Time{time.Date(2025, 1, 13, 0, 0, 0, 0, time.UTC)},
+		allDay:  true,
+	}
+
+	var got []string
+	for _, occ := range rec.occurrences(dtstart, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		got = append(got, occ.Format("20060102"))
+	}
+
+	want := []string{"20250106", "20250108", "20250120", "20250127"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("occurrences = %v, want %v", got, want)
+	}
+}
+
+func TestRecurrenceCountsStart(t *testing.T) {
+	// A Tuesday start is the first of two instances, even though the rule
+	// only generates Mondays.
+	dtstart := time.Date(2026, 1, 6, 0, 0, 0, 0, time.UTC)
+	rule, err := ics.ParseRecurrenceRule("FREQ=WEEKLY;BYDAY=MO;COUNT=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &recurrence{rrules: []*ics.RecurrenceRule{rule}, allDay: true}
+
+	var got []string
+	for _, occ := range rec.occurrences(dtstart, time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		got = append(got, occ.Format("20060102"))
+	}
+
+	want := []string{"20260106", "20260112"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("occurrences = %v, want %v", got, want)
+	}
+}
+
+func TestCreatePageRecurring(t *testing.T) {
+	cal := ics.NewCalendar()
+	today := time.Now()
+	today = time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, time.Local)
+
+	// A weekly two-day stay, starting eight weeks ago, that includes today.
+	start := today.AddDate(0, 0, -56)
+	ev := cal.AddEvent("oslo-office")
+	ev.SetAllDayStartAt(start)
+	ev.SetAllDayEndAt(start.AddDate(0, 0, 2))
+	ev.SetSummary("Oslo office")
+	ev.AddRrule("FREQ=WEEKLY")
+	ev.AddExdate(start.AddDate(0, 0, 7).Format("20060102"), ics.WithValue(string(ics.ValueDataTypeDate)))
+
+	// Next week's instance is moved and renamed.
+	override := cal.AddEvent("oslo-office")
+	override.AddProperty(
+		ics.ComponentPropertyRecurrenceId,
+		today.AddDate(0, 0, 7).Format("20060102"),
+		ics.WithValue(string(ics.ValueDataTypeDate)),
+	)
+	override.SetAllDayStartAt(today.AddDate(0, 0, 8))
+	override.SetAllDayEndAt(today.AddDate(0, 0, 10))
+	override.SetSummary("Oslo office (moved)")
+
+	p, err := createPage(cal, defaultWindow, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Current == nil || p.Current.Summary != "Oslo office" {
+		t.Fatalf("Current = %+v, want the recurring instance", p.Current)
+	}
+
+	if !p.Current.From.Equal(today) {
+		t.Errorf("Current.From = %s, want %s", p.Current.From, today)
+	}
+
+	// Eight weeks back excluding the current and the EXDATE instance.
+	if len(p.Past) != 7 {
+		t.Errorf("Past: got %d events, want 7", len(p.Past))
+	}
+
+	if len(p.Future) == 0 || p.Future[0].Summary != "Oslo office (moved)" {
+		t.Fatalf("Future[0] is not the override: %+v", p.Future)
+	}
+
+	if !p.Future[0].From.Equal(today.AddDate(0, 0, 8)) {
+		t.Errorf("override From = %s, want %s", p.Future[0].From, today.AddDate(0, 0, 8))
+	}
+
+	for _, pe := range p.Future {
+		if pe.From.Equal(today.AddDate(0, 0, 7)) {
+			t.Errorf("overridden instance still present: %+v", pe)
+		}
+	}
+}
+
+// ============================================================
+// Time zones
+// ============================================================
+
+func TestTimezonesParse(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skipf("no time zone database: %s", err)
+	}
+
+	tzs := timezones{"W. Europe Standard Time": time.FixedZone("W. Europe Standard Time", 3600)}
+
+	tests := []struct {
+		value      string
+		params     map[string][]string
+		want       time.Time
+		wantAllDay bool
+	}{
+		{
+			value:      "20250301",
+			params:     map[string][]string{"VALUE": {"DATE"}},
+			want:       time.Date(2025, 3, 1, 0, 0, 0, 0, time.Local),
+			wantAllDay: true,
+		},
+		{
+			value: "20250301T230000",
+			params: map[string][]string{
+				"TZID": {"Asia/Tokyo"},
+			},
+			want: time.Date(2025, 3, 1, 23, 0, 0, 0, tokyo),
+		},
+		{
+			value: "20250301T230000",
+			params: map[string][]string{
+				"TZID": {"/mozilla.org/20050126_1/Asia/Tokyo"},
+			},
+			want: time.Date(2025, 3, 1, 23, 0, 0, 0, tokyo),
+		},
+		{
+			value: "20250301T120000",
+			params: map[string][]string{
+				"TZID": {"W. Europe Standard Time"},
+			},
+			want: time.Date(2025, 3, 1, 11, 0, 0, 0, time.UTC),
+		},
+		{
+			value: "20250301T140000Z",
+			want:  time.Date(2025, 3, 1, 14, 0, 0, 0, time.UTC),
+		},
+		{
+			value: "20250301T140000",
+			want:  time.Date(2025, 3, 1, 14, 0, 0, 0, time.Local),
+		},
+	}
+
+	for _, tt := range tests {
+		got, allDay, err := tzs.parse(tt.value, tt.params)
+		if err != nil {
+			t.Errorf("parse(%q, %v): %s", tt.value, tt.params, err)
+
+			continue
+		}
+
+		if !got.Equal(tt.want) || allDay != tt.wantAllDay {
+			t.Errorf("parse(%q, %v) = %s, %t, want %s, %t", tt.value, tt.params, got, allDay, tt.want, tt.wantAllDay)
+		}
+	}
+
+	if _, _, err := tzs.parse("20250301T120000", map[string][]string{"TZID": {"Nowhere/Special"}}); err == nil {
+		t.Error("expected error for unknown TZID")
+	}
+}
+
+func TestCalendarTimezonesFromVTimezone(t *testing.T) {
+	cal := ics.NewCalendar()
+	vtz := cal.AddTimezone("Custom Time")
+	std := vtz.AddStandard()
+	std.AddProperty(ics.ComponentProperty(ics.PropertyTzoffsetto), "+0530")
+
+	tzs := calendarTimezones(cal)
+
+	got, _, err := tzs.parse("20250301T120000", map[string][]string{"TZID": {"Custom Time"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := time.Date(2025, 3, 1, 6, 30, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		input    string
+		wantDays int
+		want     time.Duration
+	}{
+		{"P1W", 7, 0},
+		{"P2D", 2, 0},
+		{"PT1H30M", 0, 90 * time.Minute},
+		{"P1DT12H", 1, 12 * time.Hour},
+		{"-PT15M", 0, -15 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		days, d, err := parseDuration(tt.input)
+		if err != nil {
+			t.Errorf("parseDuration(%q): %s", tt.input, err)
+
+			continue
+		}
+
+		if days != tt.wantDays || d != tt.want {
+			t.Errorf("parseDuration(%q) = %d, %s, want %d, %s", tt.input, days, d, tt.wantDays, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"", "P", "PT", "1D", "P1H"} {
+		if _, _, err := parseDuration(bad); err == nil {
+			t.Errorf("parseDuration(%q): expected error", bad)
+		}
+	}
+}
+
+func TestCreatePageTimedEvent(t *testing.T) {
+	oslo, err := time.LoadLocation("Europe/Oslo")
+	if err != nil {
+		t.Skipf("no time zone database: %s", err)
+	}
+
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skipf("no time zone database: %s", err)
+	}
+
+	// A flight that left Oslo two hours ago and lands in Tokyo in an hour.
+	now := time.Now()
+	dep := now.Add(-2 * time.Hour).In(oslo)
+	arr := now.Add(time.Hour).In(tokyo)
+
+	ical := "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//test//EN\r\n" +
+		"BEGIN:VEVENT\r\nUID:flight\r\n" +
+		"DTSTART;TZID=Europe/Oslo:" + dep.Format(icalDateTimeFormat) + "\r\n" +
+		"DTEND;TZID=Asia/Tokyo:" + arr.Format(icalDateTimeFormat) + "\r\n" +
+		"SUMMARY:OSL-NRT\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nUID:meeting\r\n" +
+		"DTSTART:" + now.Add(48*time.Hour).UTC().Format(icalDateTimeFormat) + "Z\r\n" +
+		"DURATION:PT1H\r\nSUMMARY:Meeting\r\nEND:VEVENT\r\n" +
+		"END:VCALENDAR\r\n"
+
+	cal, err := ics.ParseCalendar(strings.NewReader(ical))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := createPage(cal, defaultWindow, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Current == nil || p.Current.Summary != "OSL-NRT" {
+		t.Fatalf("Current = %+v, want the flight", p.Current)
+	}
+
+	if p.Current.AllDay {
+		t.Error("flight should not be all-day")
+	}
+
+	if p.Current.To.Location().String() != tokyo.String() {
+		t.Errorf("To location = %s, want Asia/Tokyo", p.Current.To.Location())
+	}
+
+	rendered := event(*p.Current).Render()
+	if !strings.Contains(rendered, arr.Format(timeZoneFormat)) {
+		t.Errorf("rendered event does not contain Tokyo arrival %q: %s", arr.Format(timeZoneFormat), rendered)
+	}
+
+	if len(p.Future) != 1 || p.Future[0].To.Sub(p.Future[0].From) != time.Hour {
+		t.Errorf("Future = %+v, want one hour long meeting", p.Future)
+	}
+}
+
+func TestCreatePageTimedRecurring(t *testing.T) {
+	oslo, err := time.LoadLocation("Europe/Oslo")
+	if err != nil {
+		t.Skipf("no time zone database: %s", err)
+	}
+
+	// A daily standup in Oslo time, keeping 09:00 across DST changes.
+	start := time.Now().In(oslo).AddDate(0, 0, -200)
+	start = time.Date(start.Year(), start.Month(), start.Day(), 9, 0, 0, 0, oslo)
+
+	cal := ics.NewCalendar()
+	ev := cal.AddEvent("standup")
+	ev.SetProperty(ics.ComponentPropertyDtStart, start.Format(icalDateTimeFormat), &ics.KeyValues{Key: "TZID", Value: []string{"Europe/Oslo"}})
+	ev.SetProperty(ics.ComponentPropertyDtEnd, start.Add(15*time.Minute).Format(icalDateTimeFormat), &ics.KeyValues{Key: "TZID", Value: []string{"Europe/Oslo"}})
+	ev.SetSummary("Standup")
+	ev.AddRrule("FREQ=DAILY")
+
+	p, err := createPage(cal, defaultWindow, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pe := range append(p.Past, p.Future...) {
+		local := pe.From.In(oslo)
+		if local.Hour() != 9 || local.Minute() != 0 {
+			t.Fatalf("instance at %s, want 09:00 Oslo time", local)
+		}
+
+		if pe.To.Sub(pe.From) != 15*time.Minute {
+			t.Fatalf("instance lasts %s, want 15m", pe.To.Sub(pe.From))
+		}
+	}
+}
+
+// ============================================================
+// Overlapping events
+// ============================================================
+
+func addLocatedEvent(cal *ics.Calendar, uid string, start, end time.Time, summary string) *ics.VEvent {
+	event := cal.AddEvent(uid)
+	event.SetAllDayStartAt(start)
+	event.SetAllDayEndAt(end)
+	event.SetSummary(summary)
+	event.AddProperty(
+		ics.ComponentProperty("X-APPLE-STRUCTURED-LOCATION"),
+		"geo:52.1601,4.4970",
+		&ics.KeyValues{Key: "X-TITLE", Value: []string{summary}},
+	)
+
+	return event
+}
+
+func TestCreatePageOverlapping(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name           string
+		configure      func(stay, conference, dinner *ics.VEvent)
+		wantCurrent    string
+		wantConcurrent []string
+	}{
+		{
+			name:           "shortest with location wins",
+			configure:      func(_, _, _ *ics.VEvent) {},
+			wantCurrent:    "Conference",
+			wantConcurrent: []string{"Stay", "Dinner"},
+		},
+		{
+			name: "explicit priority",
+			configure: func(stay, _, _ *ics.VEvent) {
+				stay.AddProperty(ics.ComponentProperty(propHvorPriority), "5")
+			},
+			wantCurrent:    "Stay",
+			wantConcurrent: []string{"Conference", "Dinner"},
+		},
+		{
+			name: "primary category",
+			configure: func(_, _, dinner *ics.VEvent) {
+				dinner.AddCategory("Travel,hvor-primary")
+			},
+			wantCurrent:    "Dinner",
+			wantConcurrent: []string{"Conference", "Stay"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cal := ics.NewCalendar()
+
+			// The conference is listed last to make sure calendar order
+			// does not decide.
+			stay := addLocatedEvent(cal, "stay", now.AddDate(0, 0, -5), now.AddDate(0, 0, 5), "Stay")
+			dinner := cal.AddEvent("dinner")
+			dinner.SetAllDayStartAt(now)
+			dinner.SetAllDayEndAt(now.AddDate(0, 0, 1))
+			dinner.SetSummary("Dinner")
+			conference := addLocatedEvent(cal, "conference", now.AddDate(0, 0, -1), now.AddDate(0, 0, 2), "Conference")
+
+			tt.configure(stay, conference, dinner)
+
+			p, err := createPage(cal, defaultWindow, t.Logf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if p.Current == nil || p.Current.Summary != tt.wantCurrent {
+				t.Fatalf("Current = %+v, want %q", p.Current, tt.wantCurrent)
+			}
+
+			var got []string
+			for _, pe := range p.Concurrent {
+				got = append(got, pe.Summary)
+			}
+
+			if fmt.Sprint(got) != fmt.Sprint(tt.wantConcurrent) {
+				t.Errorf("Concurrent = %v, want %v", got, tt.wantConcurrent)
+			}
+		})
+	}
+}
+
+func TestHvorPageConcurrent(t *testing.T) {
+	p := &page{
+		Current:    &pageEvent{Summary: "Conference", AllDay: true},
+		Concurrent: pageEvents{{Summary: "Long stay", AllDay: true}},
+	}
+
+	rendered := hvorPage(p, person{}, nil, "", freshness{lastFetch: time.Now()}).Render()
+
+	for _, want := range []string{"Conference", "Also", "Long stay"} {
+		if !strings.Contains(rendered, want) {
+			t.Errorf("rendered page does not contain %q", want)
+		}
+	}
+}
+
+// ============================================================
+// Persisted snapshots
+// ============================================================
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	fetched := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	cals := []sourceCalendar{
+		{url: "https://example.com/a.ics", raw: []byte(validICS), lastFetch: fetched},
+		{url: "https://example.com/never-fetched.ics"},
+	}
+
+	if err := saveSnapshot(dir, cals, fetched); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := loadSnapshot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !stored.LastFetch.Equal(fetched) {
+		t.Errorf("LastFetch = %s, want %s", stored.LastFetch, fetched)
+	}
+
+	if len(stored.Calendars) != 1 {
+		t.Fatalf("stored %d calendars, want 1", len(stored.Calendars))
+	}
+
+	if got := stored.Calendars["https://example.com/a.ics"].Calendar; got != validICS {
+		t.Errorf("Calendar = %q, want %q", got, validICS)
+	}
+
+	if _, err := loadSnapshot(t.TempDir()); err == nil {
+		t.Error("expected error loading from empty state directory")
+	}
+}
+
+func TestHvorServesStaleSnapshot(t *testing.T) {
+	up := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if !up {
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+			return
+		}
+
+		_, _ = fmt.Fprint(w, validICS)
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+
+	first := testHvor(t, config{Sources: []string{ts.URL}})
+	first.stateDir = dir
+	if err := first.updateCalendar(); err != nil {
+		t.Fatal(err)
+	}
+
+	fetched := first.snap.Load().lastFetch
+
+	// A restart while the calendar is down serves the persisted snapshot.
+	up = false
+	h := testHvor(t, config{Sources: []string{ts.URL}})
+	h.stateDir = dir
+
+	if err := h.updateCalendar(); err == nil {
+		t.Fatal("expected update to fail while calendar is down")
+	}
+
+	if err := h.restoreSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := h.snap.Load()
+	if !s.stale {
+		t.Error("restored snapshot should be stale")
+	}
+
+	if !s.lastFetch.Equal(fetched) {
+		t.Errorf("lastFetch = %s, want %s", s.lastFetch, fetched)
+	}
+
+	h.conf.Store(&config{Sources: []string{ts.URL}, tokens: parseTokens("tok")})
+	r := withSession(h, httptest.NewRequest("GET", "/", nil), "tok")
+	w := httptest.NewRecorder()
+	h.handler().ServeHTTP(w, r)
+
+	if !strings.Contains(w.Body.String(), "Stale since") {
+		t.Error("page does not show the stale indicator")
+	}
+
+	// The next successful fetch clears it.
+	up = true
+
+	if err := h.updateCalendar(); err != nil {
+		t.Fatal(err)
+	}
+
+	if h.snap.Load().stale {
+		t.Error("snapshot should not be stale after a successful fetch")
+	}
+}
+
+func TestHvorMarkStale(t *testing.T) {
+	h := &hvor{logf: t.Logf}
+
+	// Nothing to mark before the first snapshot.
+	h.markStale()
+
+	if h.snap.Load() != nil {
+		t.Fatal("markStale should not create a snapshot")
+	}
+
+	cal, err := parseCalendar([]byte(validICS))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetched := time.Now().Add(-time.Hour)
+	if err := h.setCalendar(snapshot{
+		lastFetch: fetched,
+		calendars: []sourceCalendar{{raw: []byte(validICS), cal: cal, lastFetch: fetched}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	h.markStale()
+
+	s := h.snap.Load()
+	if !s.stale || !s.lastFetch.Equal(fetched) {
+		t.Errorf("snapshot = stale %t at %s, want stale at %s", s.stale, s.lastFetch, fetched)
+	}
+}
+
+// ============================================================
+// Conditional fetching
+// ============================================================
+
+func TestFetchCalendarBodyConditional(t *testing.T) {
+	const etag = `"v1"`
+
+	var requests []*http.Request
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+
+			return
+		}
+
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", "Sat, 01 Mar 2025 12:00:00 GMT")
+		_, _ = fmt.Fprint(w, validICS)
+	}))
+	defer ts.Close()
+
+	body, v, err := fetchCalendarBody(ts.URL, validators{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(body) != validICS {
+		t.Errorf("body = %q, want %q", body, validICS)
+	}
+
+	if v.etag != etag || v.lastModified == "" {
+		t.Errorf("validators = %+v, want etag and last-modified", v)
+	}
+
+	_, v2, err := fetchCalendarBody(ts.URL, v)
+	if !errors.Is(err, errNotModified) {
+		t.Fatalf("err = %v, want errNotModified", err)
+	}
+
+	if v2 != v {
+		t.Errorf("validators after 304 = %+v, want %+v", v2, v)
+	}
+
+	if got := requests[1].Header.Get("If-Modified-Since"); got != v.lastModified {
+		t.Errorf("If-Modified-Since = %q, want %q", got, v.lastModified)
+	}
+}
+
+func TestUpdateCalendarSkipsUnchanged(t *testing.T) {
+	body := validICS
+	etag := ""
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if etag != "" && r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+
+			return
+		}
+
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+
+		_, _ = fmt.Fprint(w, body)
+	}))
+	defer ts.Close()
+
+	h := testHvor(t, config{Sources: []string{ts.URL}})
+
+	if err := h.updateCalendar(); err != nil {
+		t.Fatal(err)
+	}
+
+	first := h.snap.Load()
+
+	// Same body without validators: the content hash matches.
+	if err := h.updateCalendar(); err != nil {
+		t.Fatal(err)
+	}
+
+	second := h.snap.Load()
+	if second.calPage != first.calPage {
+		t.Error("unchanged body should reuse the page")
+	}
+
+	if second.lastFetch.Before(first.lastFetch) {
+		t.Error("lastFetch should move forward")
+	}
+
+	// Not modified: the page is reused too.
+	etag = `"v1"`
+
+	if err := h.updateCalendar(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.updateCalendar(); err != nil {
+		t.Fatal(err)
+	}
+
+	if h.snap.Load().calPage != first.calPage {
+		t.Error("not modified calendar should reuse the page")
+	}
+
+	// A changed body builds a new page.
+	body = strings.Replace(validICS, "Test Event", "Changed Event", 1)
+	etag = `"v2"`
+
+	if err := h.updateCalendar(); err != nil {
+		t.Fatal(err)
+	}
+
+	if h.snap.Load().calPage == first.calPage {
+		t.Error("changed body should build a new page")
+	}
+}
+
+func TestPageExpiry(t *testing.T) {
+	now := time.Now()
+
+	p := &page{
+		Current: &pageEvent{From: now.Add(-time.Hour), To: now.Add(3 * time.Hour)},
+		Future:  pageEvents{{From: now.Add(2 * time.Hour), To: now.Add(5 * time.Hour)}},
+	}
+
+	if got, want := pageExpiry(p, now), now.Add(2*time.Hour); !got.Equal(want) {
+		t.Errorf("pageExpiry = %s, want %s", got, want)
+	}
+
+	if got, want := pageExpiry(&page{}, now), now.Add(24*time.Hour); !got.Equal(want) {
+		t.Errorf("pageExpiry of empty page = %s, want %s", got, want)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for failures := 1; failures < 100; failures++ {
+		d := backoff(failures, defaultRefreshPeriod)
+
+		want := minBackoff << min(failures-1, 10)
+		want = min(want, defaultRefreshPeriod)
+
+		if d < want/2 || d > want {
+			t.Errorf("backoff(%d) = %s, want within [%s, %s]", failures, d, want/2, want)
+		}
+	}
+}
+
+// ============================================================
+// Multiple sources
+// ============================================================
+
+func TestParseSources(t *testing.T) {
+	got := parseSources(" https://a.example/cal.ics, ,webcal://b.example/x,/var/cal.ics ")
+	want := []string{"https://a.example/cal.ics", "webcal://b.example/x", "/var/cal.ics"}
+
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("parseSources = %v, want %v", got, want)
+	}
+
+	if got := parseSources(""); len(got) != 0 {
+		t.Errorf("parseSources(\"\") = %v, want empty", got)
+	}
+}
+
+func TestRedactSource(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{"https://p12-caldav.icloud.com/published/2/secret", "https://p12-caldav.icloud.com/…"},
+		{"webcal://example.com", "webcal://example.com"},
+		{"/var/lib/hvor/cal.ics", "/var/lib/hvor/cal.ics"},
+		{"file:///var/lib/hvor/cal.ics", "file:///var/lib/hvor/cal.ics"},
+	}
+
+	for _, tt := range tests {
+		if got := redactSource(tt.src); got != tt.want {
+			t.Errorf("redactSource(%q) = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestFetchSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cal.ics")
+	if err := os.WriteFile(path, []byte(validICS), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = fmt.Fprint(w, validICS)
+	}))
+	defer ts.Close()
+
+	origTransport := httpClient.Transport
+	httpClient.Transport = ts.Client().Transport
+
+	defer func() { httpClient.Transport = origTransport }()
+
+	for _, src := range []string{
+		path,
+		"file://" + path,
+		ts.URL,
+		strings.Replace(ts.URL, "https://", "webcal://", 1),
+	} {
+		body, _, err := fetchSource(src, validators{}, defaultWindow, "")
+		if err != nil {
+			t.Errorf("fetchSource(%q): %s", src, err)
+
+			continue
+		}
+
+		if string(body) != validICS {
+			t.Errorf("fetchSource(%q) = %q, want %q", src, body, validICS)
+		}
+	}
+
+	if _, _, err := fetchSource("ftp://example.com/cal.ics", validators{}, defaultWindow, ""); err == nil {
+		t.Error("expected error for unsupported scheme")
+	}
+}
+
+func TestMergeCalendars(t *testing.T) {
+	now := time.Now()
+
+	travel := ics.NewCalendar()
+	addAllDayEvent(travel, "shared", now.AddDate(0, 0, 10), now.AddDate(0, 0, 12), "Old title")
+	addAllDayEvent(travel, "travel-only", now.AddDate(0, 0, 20), now.AddDate(0, 0, 22), "Travel")
+
+	conferences := ics.NewCalendar()
+	updated := conferences.AddEvent("shared")
+	updated.SetAllDayStartAt(now.AddDate(0, 0, 10))
+	updated.SetAllDayEndAt(now.AddDate(0, 0, 12))
+	updated.SetSummary("New title")
+	updated.SetSequence(2)
+	addAllDayEvent(conferences, "conference-only", now.AddDate(0, 0, 30), now.AddDate(0, 0, 32), "Conference")
+
+	merged := mergeCalendars([]*ics.Calendar{travel, nil, conferences})
+
+	var got []string
+	for _, ev := range merged.Events() {
+		got = append(got, ev.GetProperty(ics.ComponentPropertySummary).Value)
+	}
+
+	want := []string{"New title", "Travel", "Conference"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("merged events = %v, want %v", got, want)
+	}
+}
+
+func TestUpdateCalendarMultipleSources(t *testing.T) {
+	now := time.Now()
+
+	conferences := ics.NewCalendar()
+	addAllDayEvent(conferences, "conf", now.AddDate(0, 0, 10), now.AddDate(0, 0, 12), "Conference")
+
+	path := filepath.Join(t.TempDir(), "conferences.ics")
+	if err := os.WriteFile(path, []byte(conferences.Serialize()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	travel := ics.NewCalendar()
+	addAllDayEvent(travel, "trip", now.AddDate(0, 0, 20), now.AddDate(0, 0, 22), "Trip")
+
+	up := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if !up {
+			w.WriteHeader(http.StatusBadGateway)
+
+			return
+		}
+
+		_, _ = fmt.Fprint(w, travel.Serialize())
+	}))
+	defer ts.Close()
+
+	h := testHvor(t, config{Sources: []string{ts.URL, path}})
+
+	if err := h.updateCalendar(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := len(h.snap.Load().calPage.Future); got != 2 {
+		t.Fatalf("Future has %d events, want 2", got)
+	}
+
+	// One source failing keeps its last known data.
+	up = false
+
+	if err := h.updateCalendar(); err != nil {
+		t.Fatalf("partial failure should not fail the update: %s", err)
+	}
+
+	s := h.snap.Load()
+	if got := len(s.calPage.Future); got != 2 {
+		t.Errorf("Future has %d events after partial failure, want 2", got)
+	}
+
+	health := s.health()
+	if health[0].Error == "" || health[1].Error != "" {
+		t.Errorf("health = %+v, want only the first source failing", health)
+	}
+
+	if f := s.freshness(); f.unavailable != 1 || f.sources != 2 || f.stale {
+		t.Errorf("freshness = %+v, want 1 of 2 unavailable", f)
+	}
+
+	// All sources failing is an error.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.updateCalendar(); err == nil {
+		t.Error("expected error when every source fails")
+	}
+
+	w := httptest.NewRecorder()
+	h.sourcesHandler().ServeHTTP(w, httptest.NewRequest("GET", "/debug/sources", nil))
+
+	if !strings.Contains(w.Body.String(), redactSource(ts.URL)) {
+		t.Errorf("sources handler does not report %s: %s", redactSource(ts.URL), w.Body.String())
+	}
+}
+
+// ============================================================
+// CalDAV
+// ============================================================
+
+// caldavStandIn is a minimal CalDAV server with a calendar home holding two
+// calendars, requiring the given Authorization header.
+type caldavStandIn struct {
+	authorization string
+	calendars     map[string]*ics.Calendar
+	ctag          string
+	reports       int
+	lastQuery     string
+}
+
+func (c *caldavStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != c.authorization {
+		w.WriteHeader(http.StatusUnauthorized)
+
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+
+	var sb strings.Builder
+
+	sb.WriteString(`<?xml version="1.0" encoding="utf-8"?>` +
+		`<d:multistatus xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav" xmlns:cs="http://calendarserver.org/ns/">`)
+
+	calendarResponse := func(path string) {
+		fmt.Fprintf(&sb, `<d:response><d:href>%s</d:href><d:propstat><d:prop>`+
+			`<d:resourcetype><d:collection/><c:calendar/></d:resourcetype><cs:getctag>%s</cs:getctag>`+
+			`</d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>`, path, c.ctag)
+	}
+
+	switch {
+	case r.Method == "PROPFIND" && r.URL.Path == "/home/":
+		sb.WriteString(`<d:response><d:href>/home/</d:href><d:propstat><d:prop>` +
+			`<d:resourcetype><d:collection/></d:resourcetype>` +
+			`</d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>`)
+
+		if r.Header.Get("Depth") == "1" {
+			for path := range c.calendars {
+				calendarResponse(path)
+			}
+		}
+	case r.Method == "PROPFIND":
+		if _, ok := c.calendars[r.URL.Path]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+
+			return
+		}
+
+		calendarResponse(r.URL.Path)
+	case r.Method == "REPORT":
+		cal, ok := c.calendars[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+
+			return
+		}
+
+		c.reports++
+		c.lastQuery = string(body)
+
+		var data strings.Builder
+		if err := xml.EscapeText(&data, []byte(cal.Serialize())); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+
+			return
+		}
+
+		fmt.Fprintf(&sb, `<d:response><d:href>%sevent.ics</d:href><d:propstat><d:prop>`+
+			`<d:getetag>"1"</d:getetag><c:calendar-data>%s</c:calendar-data>`+
+			`</d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>`, r.URL.Path, data.String())
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	sb.WriteString(`</d:multistatus>`)
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	_, _ = w.Write([]byte(sb.String()))
+}
+
+func TestLoadCalDAVAuth(t *testing.T) {
+	dir := t.TempDir()
+
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		return path
+	}
+
+	auth, err := loadCalDAVAuth(write("basic", "hvor:s3cr:et\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if auth.username != "hvor" || auth.password != "s3cr:et" {
+		t.Errorf("basic auth = %+v", auth)
+	}
+
+	auth, err = loadCalDAVAuth(write("bearer", "Bearer abc123\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if auth.token != "abc123" {
+		t.Errorf("bearer auth = %+v", auth)
+	}
+
+	if _, err := loadCalDAVAuth(write("bad", "no-separator")); err == nil {
+		t.Error("expected error for malformed credentials")
+	}
+
+	if auth, err := loadCalDAVAuth(""); err != nil || auth != (caldavAuth{}) {
+		t.Errorf("empty path = %+v, %v, want no auth", auth, err)
+	}
+}
+
+func TestFetchCalDAV(t *testing.T) {
+	now := time.Now()
+
+	travel := ics.NewCalendar()
+	addAllDayEvent(travel, "trip", now.AddDate(0, 0, 10), now.AddDate(0, 0, 12), "Trip")
+
+	work := ics.NewCalendar()
+	addAllDayEvent(work, "conf", now.AddDate(0, 0, 20), now.AddDate(0, 0, 22), "Conference")
+
+	standIn := &caldavStandIn{
+		authorization: "Bearer s3cret",
+		calendars: map[string]*ics.Calendar{
+			"/home/travel/": travel,
+			"/home/work/":   work,
+		},
+		ctag: "1",
+	}
+
+	ts := httptest.NewServer(standIn)
+	defer ts.Close()
+
+	credsPath := filepath.Join(t.TempDir(), "creds")
+	if err := os.WriteFile(credsPath, []byte("Bearer s3cret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	calendarURL := strings.Replace(ts.URL, "http://", "caldav://", 1) + "/home/travel/"
+	homeURL := strings.Replace(ts.URL, "http://", "caldav://", 1) + "/home/"
+
+	// A single calendar collection.
+	body, v, err := fetchSource(calendarURL, validators{}, defaultWindow, credsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cal, err := parseCalendar(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cal.Events()) != 1 {
+		t.Errorf("got %d events from the travel calendar, want 1", len(cal.Events()))
+	}
+
+	if !strings.Contains(standIn.lastQuery, "<c:time-range start=") {
+		t.Errorf("calendar-query has no time-range filter: %s", standIn.lastQuery)
+	}
+
+	// An unchanged ctag skips the query.
+	reports := standIn.reports
+
+	if _, _, err := fetchSource(calendarURL, v, defaultWindow, credsPath); !errors.Is(err, errNotModified) {
+		t.Errorf("err = %v, want errNotModified", err)
+	}
+
+	if standIn.reports != reports {
+		t.Error("unchanged calendar was queried again")
+	}
+
+	// A calendar home merges all of its calendars.
+	body, _, err = fetchSource(homeURL, validators{}, defaultWindow, credsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cal, err = parseCalendar(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cal.Events()) != 2 {
+		t.Errorf("got %d events from the calendar home, want 2", len(cal.Events()))
+	}
+
+	// Wrong credentials fail.
+	if err := os.WriteFile(credsPath, []byte("hvor:wrong"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := fetchSource(calendarURL, validators{}, defaultWindow, credsPath); err == nil {
+		t.Error("expected error with wrong credentials")
+	}
+
+	// Calendars are read with the credentials of the config.
+	ownPath := filepath.Join(t.TempDir(), "own")
+	if err := os.WriteFile(ownPath, []byte("Bearer s3cret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, ok := range map[string]bool{ownPath: true, credsPath: false} {
+		h := testHvor(t, config{Sources: []string{calendarURL}, CalDAVCredentials: path})
+		if err := h.updateCalendar(); (err == nil) != ok {
+			t.Errorf("update with the credentials at %s: err = %v, want success %t", path, err, ok)
+		}
+	}
+}
+
+// ============================================================
+// JSON API
+// ============================================================
+
+func TestWhereaboutsAPI(t *testing.T) {
+	now := time.Now()
+
+	cal := ics.NewCalendar()
+	addLocatedEvent(cal, "current", now.AddDate(0, 0, -1), now.AddDate(0, 0, 2), "Leiden")
+	addAllDayEvent(cal, "future", now.AddDate(0, 0, 10), now.AddDate(0, 0, 12), "Trip")
+	addAllDayEvent(cal, "past", now.AddDate(0, 0, -20), now.AddDate(0, 0, -18), "Home")
+
+	h := testHvor(t, config{tokens: parseTokens("tok")})
+	if err := h.setCalendar(snapshot{
+		lastFetch: now,
+		calendars: []sourceCalendar{{url: "test", cal: cal}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	h.whereaboutsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/whereabouts", nil))
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status without token = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	w = httptest.NewRecorder()
+	h.whereaboutsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/whereabouts?from=tok", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	var got whereabouts
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Current == nil || got.Current.Summary != "Leiden" {
+		t.Fatalf("current = %+v, want Leiden", got.Current)
+	}
+
+	loc := got.Current.Location
+	if loc == nil || loc.Latitude == nil || *loc.Latitude != 52.1601 || loc.Longitude == nil || *loc.Longitude != 4.4970 {
+		t.Errorf("current location = %+v, want 52.1601, 4.4970", loc)
+	}
+
+	if !got.Current.AllDay {
+		t.Error("current should be all-day")
+	}
+
+	if len(got.Future) != 1 || got.Future[0].Summary != "Trip" {
+		t.Errorf("future = %+v, want Trip", got.Future)
+	}
+
+	if len(got.Past) != 1 || got.Past[0].Summary != "Home" {
+		t.Errorf("past = %+v, want Home", got.Past)
+	}
+
+	if !got.LastFetch.Equal(now.Truncate(0)) {
+		t.Errorf("lastFetch = %s, want %s", got.LastFetch, now)
+	}
+}
+
+// ============================================================
+// iCal feed
+// ============================================================
+
+func TestFeedCalendar(t *testing.T) {
+	now := time.Now()
+
+	cal := ics.NewCalendar()
+	event := cal.AddEvent("seattle")
+	event.SetAllDayStartAt(now.AddDate(0, 0, -1))
+	event.SetAllDayEndAt(now.AddDate(0, 0, 2))
+	event.SetSummary("Seattle")
+	event.SetDescription("Hotel room 1234\\nCall me")
+	event.SetOrganizer("mailto:private@example.com")
+	event.AddProperty(
+		ics.ComponentProperty("X-APPLE-STRUCTURED-LOCATION"),
+		"geo:47.6062,-122.3321",
+		&ics.KeyValues{Key: "X-TITLE", Value: []string{"Seattle, WAnUnited States"}},
+		&ics.KeyValues{Key: "X-APPLE-RADIUS", Value: []string{"5000"}},
+	)
+	addAllDayEvent(cal, "future", now.AddDate(0, 0, 10), now.AddDate(0, 0, 12), "Trip")
+
+	p, err := createPage(cal, defaultWindow, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, withDescriptions := range []bool{false, true} {
+		feed := feedCalendar(p, withDescriptions, defaultRefreshPeriod, now).Serialize()
+
+		if strings.Contains(feed, "private@example.com") {
+			t.Error("feed leaks the organizer")
+		}
+
+		if got := strings.Contains(feed, "Hotel room"); got != withDescriptions {
+			t.Errorf("withDescriptions=%t: feed has description = %t", withDescriptions, got)
+		}
+
+		parsed, err := ics.ParseCalendar(strings.NewReader(feed))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(parsed.Events()) != 2 {
+			t.Fatalf("got %d events, want 2", len(parsed.Events()))
+		}
+
+		if geo := parsed.Events()[0].GetProperty(ics.ComponentPropertyGeo); geo == nil || geo.Value != "47.6062;-122.3321" {
+			t.Errorf("GEO = %v, want 47.6062;-122.3321", geo)
+		}
+
+		// The feed reads back as the same page.
+		republished, err := createPage(parsed, defaultWindow, t.Logf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cur := republished.Current
+		if cur == nil || cur.Location == nil {
+			t.Fatalf("republished current = %+v, want a located event", cur)
+		}
+
+		if cur.Location.Title != "Seattle, Washington, United States" {
+			t.Errorf("title = %q, want cleaned title", cur.Location.Title)
+		}
+
+		if cur.Location.Radius != 5000 || cur.Location.Latitude != "47.6062" || cur.Location.Longitude != "-122.3321" {
+			t.Errorf("location = %+v", cur.Location)
+		}
+
+		if !cur.From.Equal(p.Current.From) || !cur.To.Equal(p.Current.To) || !cur.AllDay {
+			t.Errorf("dates = %s - %s, want %s - %s", cur.From, cur.To, p.Current.From, p.Current.To)
+		}
+
+		if withDescriptions && strings.Join(cur.Description, "\n") != strings.Join(p.Current.Description, "\n") {
+			t.Errorf("description = %q, want %q", cur.Description, p.Current.Description)
+		}
+	}
+}
+
+func TestICSHandlerRequiresAuthorisation(t *testing.T) {
+	h := testHvor(t, config{tokens: parseTokens("tok")})
+	if err := h.setCalendar(snapshot{calendars: []sourceCalendar{{url: "test", cal: ics.NewCalendar()}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	h.icsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/ics", nil))
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status without token = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	w = httptest.NewRecorder()
+	h.icsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/ics?from=tok", nil))
+
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/calendar") {
+		t.Errorf("status = %d, Content-Type = %q", w.Code, w.Header().Get("Content-Type"))
+	}
+}
+
+// ============================================================
+// Exports
+// ============================================================
+
+func exportTestHvor(t *testing.T) *hvor {
+	t.Helper()
+
+	now := time.Now()
+
+	cal := ics.NewCalendar()
+	addLocatedEvent(cal, "past", now.AddDate(0, 0, -20), now.AddDate(0, 0, -18), "Past")
+	addLocatedEvent(cal, "current", now.AddDate(0, 0, -1), now.AddDate(0, 0, 2), "Current")
+	addAllDayEvent(cal, "nowhere", now.AddDate(0, 0, 5), now.AddDate(0, 0, 6), "Nowhere")
+
+	future := cal.AddEvent("future")
+	future.SetAllDayStartAt(now.AddDate(0, 0, 10))
+	future.SetAllDayEndAt(now.AddDate(0, 0, 12))
+	future.SetSummary("Future")
+	future.AddProperty(
+		ics.ComponentProperty("X-APPLE-STRUCTURED-LOCATION"),
+		"geo:59.9139,10.7522",
+		&ics.KeyValues{Key: "X-TITLE", Value: []string{"Oslo"}},
+		&ics.KeyValues{Key: "X-APPLE-RADIUS", Value: []string{"1000"}},
+	)
+
+	h := testHvor(t, config{tokens: parseTokens("tok")})
+	if err := h.setCalendar(snapshot{calendars: []sourceCalendar{{url: "test", cal: cal}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	return h
+}
+
+func TestStops(t *testing.T) {
+	p := exportTestHvor(t).snap.Load().calPage
+
+	tests := []struct {
+		window string
+		want   []string
+	}{
+		{"", []string{"Past", "Current", "Future"}},
+		{"past", []string{"Past"}},
+		{"future", []string{"Future"}},
+	}
+
+	for _, tt := range tests {
+		ss, err := stops(p, tt.window)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for _, s := range ss {
+			got = append(got, s.Summary)
+		}
+
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("stops(%q) = %v, want %v", tt.window, got, tt.want)
+		}
+	}
+
+	if _, err := stops(p, "sideways"); err == nil {
+		t.Error("expected error for unknown window")
+	}
+}
+
+func TestCircle(t *testing.T) {
+	lat, lon := 59.9139, 10.7522
+
+	ring := circle(lat, lon, 1000)
+	if ring[0] != ring[len(ring)-1] {
+		t.Error("ring is not closed")
+	}
+
+	for _, pos := range ring {
+		// Haversine distance back to the centre.
+		dLat := (pos[1] - lat) * math.Pi / 180
+		dLon := (pos[0] - lon) * math.Pi / 180
+		h := math.Pow(math.Sin(dLat/2), 2) +
+			math.Cos(lat*math.Pi/180)*math.Cos(pos[1]*math.Pi/180)*math.Pow(math.Sin(dLon/2), 2)
+		d := 2 * earthRadius * math.Asin(math.Sqrt(h))
+
+		if math.Abs(d-1000) > 1 {
+			t.Fatalf("%v is %.1fm from the centre, want 1000m", pos, d)
+		}
+	}
+}
+
+func TestExportHandler(t *testing.T) {
+	h := exportTestHvor(t)
+
+	get := func(format, query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.exportHandler(format).ServeHTTP(w, httptest.NewRequest("GET", "/export/"+format+query, nil))
+
+		return w
+	}
+
+	if w := get("geojson", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("status without token = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	if w := get("geojson", "?from=tok&window=sideways"); w.Code != http.StatusBadRequest {
+		t.Errorf("status for unknown window = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	var fc struct {
+		Type     string `json:"type"`
+		Features []struct {
+			Geometry struct {
+				Type        string          `json:"type"`
+				Coordinates json.RawMessage `json:"coordinates"`
+			} `json:"geometry"`
+		} `json:"features"`
+	}
+
+	w := get("geojson", "?from=tok")
+	if err := json.Unmarshal(w.Body.Bytes(), &fc); err != nil {
+		t.Fatal(err)
+	}
+
+	var kinds []string
+	for _, f := range fc.Features {
+		kinds = append(kinds, f.Geometry.Type)
+	}
+
+	if want := "Point,Point,Point,Polygon,LineString"; fc.Type != "FeatureCollection" || strings.Join(kinds, ",") != want {
+		t.Errorf("geometries = %v, want %s", kinds, want)
+	}
+
+	if got := string(fc.Features[0].Geometry.Coordinates); got != "[4.497,52.1601]" {
+		t.Errorf("point = %s, want longitude first", got)
+	}
+
+	var doc kmlDocument
+	if err := xml.Unmarshal(get("kml", "?from=tok").Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(doc.Placemarks) != 4 || doc.Placemarks[3].LineString == nil {
+		t.Errorf("kml placemarks = %+v, want 3 stops and a line", doc.Placemarks)
+	}
+
+	var g gpxDocument
+	if err := xml.Unmarshal(get("gpx", "?from=tok&window=future").Body.Bytes(), &g); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(g.Waypoints) != 1 || g.Waypoints[0].Name != "Future" || g.Track != nil {
+		t.Errorf("gpx = %+v, want the single future waypoint", g)
+	}
+}
+
+// ============================================================
+// Token scopes
+// ============================================================
+
+func TestParseTokensScopes(t *testing.T) {
+	toks := parseTokens("full,town:city,land:country+descriptions,bad:everything")
+
+	tests := []struct {
+		token string
+		want  scope
+		valid bool
+	}{
+		{"full", fullScope, true},
+		{"town", scope{precision: precisionCity}, true},
+		{"land", scope{precision: precisionCountry, descriptions: true}, true},
+		{"bad", scope{}, false},
+		{"", scope{}, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := toks.scope(tt.token)
+		if ok != tt.valid || got != tt.want {
+			t.Errorf("scope(%q) = %+v, %t, want %+v, %t", tt.token, got, ok, tt.want, tt.valid)
+		}
+	}
+}
+
+func TestPageRestrict(t *testing.T) {
+	loc := &appleLocation{
+		Title:        "Grand Hotel, Karl Johans gate 31, Oslo, Norway",
+		Radius:       100,
+		Latitude:     "59.91364",
+		Longitude:    "10.73977",
+		MapkitHandle: "secret",
+	}
+	p := &page{
+		Current: &pageEvent{Summary: "Oslo", Location: loc, Description: []string{"Room 1234"}},
+		Future: pageEvents{
+			{Summary: "Dinner at Karl Johans gate 31", Location: loc},
+			{Summary: "Hotel Continental"},
+		},
+	}
+
+	if got := p.restrict(fullScope); got != p {
+		t.Error("full scope should not copy the page")
+	}
+
+	tests := []struct {
+		sc       scope
+		title    string
+		lat, lon string
+		radius   float64
+		desc     int
+	}{
+		{scope{precision: precisionExact}, loc.Title, loc.Latitude, loc.Longitude, 100, 0},
+		{scope{precision: precisionCity, descriptions: true}, "Oslo, Norway", "59.9", "10.7", 10_000, 1},
+		{scope{precision: precisionCountry}, "Norway", "60", "11", 150_000, 0},
+	}
+
+	for _, tt := range tests {
+		got := p.restrict(tt.sc)
+
+		cur := got.Current.Location
+		if cur.Title != tt.title || cur.Latitude != tt.lat || cur.Longitude != tt.lon || cur.Radius != tt.radius {
+			t.Errorf("%+v: location = %+v", tt.sc, cur)
+		}
+
+		if tt.sc.precision != precisionExact && cur.MapkitHandle != "" {
+			t.Errorf("%+v: mapkit handle kept", tt.sc)
+		}
+
+		if len(got.Current.Description) != tt.desc {
+			t.Errorf("%+v: description = %q", tt.sc, got.Current.Description)
+		}
+
+		if got.Future[0].Location.Title != tt.title {
+			t.Errorf("%+v: future title = %q", tt.sc, got.Future[0].Location.Title)
+		}
+
+		summaries := []string{"Dinner at Karl Johans gate 31", "Hotel Continental"}
+		if tt.sc.precision != precisionExact {
+			summaries = []string{tt.title, redactedSummary}
+		}
+
+		if got := []string{got.Future[0].Summary, got.Future[1].Summary}; !slices.Equal(got, summaries) {
+			t.Errorf("%+v: summaries = %q, want %q", tt.sc, got, summaries)
+		}
+
+		if got.Precision != tt.sc.precision {
+			t.Errorf("%+v: precision = %d", tt.sc, got.Precision)
+		}
+	}
+
+	if p.Current.Location.Title != loc.Title || len(p.Current.Description) != 1 {
+		t.Error("restrict modified the original page")
+	}
+}
+
+func TestHandlerRestrictsScope(t *testing.T) {
+	now := time.Now()
+
+	cal := ics.NewCalendar()
+	event := cal.AddEvent("hotel")
+	event.SetAllDayStartAt(now.AddDate(0, 0, -1))
+	event.SetAllDayEndAt(now.AddDate(0, 0, 2))
+	event.SetSummary("Oslo")
+	event.SetDescription("Room 1234")
+	event.AddProperty(
+		ics.ComponentProperty("X-APPLE-STRUCTURED-LOCATION"),
+		"geo:59.91364,10.73977",
+		&ics.KeyValues{Key: "X-TITLE", Value: []string{"Grand Hotel\\nOslo\\nNorway"}},
+	)
+
+	for i := range 7 {
+		addAllDayEvent(cal, fmt.Sprintf("f%d", i), now.AddDate(0, 0, 10+i), now.AddDate(0, 0, 11+i), "Later")
+	}
+
+	h := testHvor(t, config{tokens: parseTokens("full,land:country")})
+	if err := h.setCalendar(snapshot{calendars: []sourceCalendar{{url: "test", cal: cal}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(handler http.Handler, target string, token string) string {
+		r := httptest.NewRequest("GET", target, nil)
+		if token != "" {
+			r = withSession(h, r, token)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		return w.Body.String()
+	}
+
+	full := get(h.handler(), "/", "full")
+	for _, want := range []string{"Room 1234", "59.91364"} {
+		if !strings.Contains(full, want) {
+			t.Errorf("full page is missing %q", want)
+		}
+	}
+
+	land := get(h.handler(), "/", "land")
+	for _, leak := range []string{"Grand Hotel", "Room 1234", "59.91364"} {
+		if strings.Contains(land, leak) {
+			t.Errorf("country page leaks %q", leak)
+		}
+	}
+
+	if !strings.Contains(land, "maxZoom: 4") {
+		t.Error("country page does not clamp the map zoom")
+	}
+
+	// Summaries of events without a place are hidden at country precision.
+	if got := get(h.future(), "/future?from=5&to=10", "land"); !strings.Contains(got, redactedSummary) || strings.Contains(got, "Later") {
+		t.Errorf("future with session = %q", got)
+	}
+
+	if got := get(h.future(), "/future?from=5&to=10", ""); strings.Contains(got, redactedSummary) {
+		t.Error("future served events without a token")
+	}
+}
+
+// ============================================================
+// Token store
+// ============================================================
+
+func writeTokenStore(t *testing.T, path string, tokens []storedToken, modTime time.Time) {
+	t.Helper()
+
+	data, err := json.Marshal(map[string]any{"tokens": tokens})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTokenStore(t *testing.T) {
+	now := time.Now()
+	path := filepath.Join(t.TempDir(), "tokens.json")
+
+	writeTokenStore(t, path, []storedToken{
+		{Token: "forever", Label: "Family"},
+		{Token: "expired", Label: "Old friend", Expires: now.Add(-time.Hour)},
+		{Token: "trip", Label: "Conference", Scopes: "city", ValidFrom: now.AddDate(0, 0, 3), ValidUntil: now.AddDate(0, 0, 5)},
+		{Token: "revoked", Label: "Ex", Revoked: true},
+		{Token: "typo", Label: "Typo", Scopes: "citty"},
+	}, now.Add(-time.Minute))
+
+	ts, err := newTokenStore(path, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		token string
+		at    time.Time
+		valid bool
+	}{
+		{"forever", now, true},
+		{"expired", now, false},
+		{"trip", now, false},
+		{"trip", now.AddDate(0, 0, 4), true},
+		{"trip", now.AddDate(0, 0, 6), false},
+		{"revoked", now, false},
+		{"typo", now, false},
+		{"unknown", now, false},
+		{"", now, false},
+	}
+
+	for _, tt := range tests {
+		if _, ok := ts.lookup(tt.token, tt.at); ok != tt.valid {
+			t.Errorf("lookup(%q, %s) = %t, want %t", tt.token, tt.at, ok, tt.valid)
+		}
+	}
+
+	if st, _ := ts.lookup("trip", now.AddDate(0, 0, 4)); st.scope.precision != precisionCity || st.Label != "Conference" {
+		t.Errorf("trip = %+v, want city scope and its label", st)
+	}
+
+	// Revoking a link is picked up on reload.
+	writeTokenStore(t, path, []storedToken{{Token: "forever", Label: "Family", Revoked: true}}, now)
+
+	if err := ts.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := ts.lookup("forever", now); ok {
+		t.Error("revoked link is still valid after reload")
+	}
+
+	// A broken file keeps the loaded tokens.
+	if err := os.WriteFile(path, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ts.reload(); err == nil {
+		t.Error("expected error reloading a broken file")
+	}
+
+	if _, ok := ts.lookup("forever", now); ok {
+		t.Error("broken file replaced the loaded tokens")
+	}
+}
+
+func TestAuthoriseTokenStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	writeTokenStore(t, path, []storedToken{{Token: "stored", Label: "Friend", Scopes: "country"}}, time.Now())
+
+	ts, err := newTokenStore(path, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := testHvor(t, config{tokens: parseTokens("static")})
+	h.tokenStore = ts
+
+	for _, tt := range []struct {
+		from string
+		want viewer
+		ok   bool
+	}{
+		{"static", viewer{scope: fullScope, label: tokenLabel("static")}, true},
+		{"stored", viewer{scope: scope{precision: precisionCountry}, label: "Friend"}, true},
+		{"other", viewer{}, false},
+	} {
+		w := httptest.NewRecorder()
+
+		v, ok := h.authorise(w, httptest.NewRequest("GET", "/?from="+tt.from, nil), accessToken)
+		if ok != tt.ok || v != tt.want {
+			t.Errorf("authorise(%q) = %+v, %t, want %+v, %t", tt.from, v, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// ============================================================
+// Share links
+// ============================================================
+
+func TestShareLink(t *testing.T) {
+	key := []byte(strings.Repeat("k", minShareKeyLength))
+	now := time.Now()
+
+	token, err := mintShareLink(key, "Alice", "city", "", now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	link, err := verifyShareLink(key, token, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if link.Label != "Alice" || link.scope != (scope{precision: precisionCity}) {
+		t.Errorf("link = %+v, want Alice with city scope", link)
+	}
+
+	if _, err := verifyShareLink(key, token, now.Add(2*time.Hour)); !errors.Is(err, errExpiredShareLink) {
+		t.Errorf("expired link: err = %v, want errExpiredShareLink", err)
+	}
+
+	otherKey := []byte(strings.Repeat("o", minShareKeyLength))
+	if _, err := verifyShareLink(otherKey, token, now); !errors.Is(err, errBadShareLink) {
+		t.Errorf("other key: err = %v, want errBadShareLink", err)
+	}
+
+	// Widening the scope breaks the signature.
+	forged, err := mintShareLink(otherKey, "Alice", "", "", now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, _, _ := strings.Cut(forged, ".")
+	_, sig, _ := strings.Cut(token, ".")
+
+	if _, err := verifyShareLink(key, payload+"."+sig, now); !errors.Is(err, errBadShareLink) {
+		t.Errorf("forged link: err = %v, want errBadShareLink", err)
+	}
+
+	if _, err := mintShareLink(key, "Alice", "everything", "", now.Add(time.Hour)); err == nil {
+		t.Error("expected error minting a link with an unknown scope")
+	}
+}
+
+func TestMintLinkCommand(t *testing.T) {
+	key := strings.Repeat("k", minShareKeyLength)
+	keyPath := filepath.Join(t.TempDir(), "share.key")
+
+	if err := os.WriteFile(keyPath, []byte(key+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+
+	err := mintLinkCommand([]string{
+		"-share-key-path", keyPath,
+		"-label", "Bob",
+		"-scopes", "country",
+		"-valid", "24h",
+		"-base-url", "https://hvor.example.com/",
+	}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	link, _, _ := strings.Cut(out.String(), "\n")
+
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Host != "hvor.example.com" {
+		t.Errorf("link = %s, want it on the base url", link)
+	}
+
+	h := &hvor{shareKey: []byte(key), logf: t.Logf}
+
+	v, ok := h.authorise(httptest.NewRecorder(), httptest.NewRequest("GET", "/?"+u.RawQuery, nil), accessToken)
+	if !ok || v.scope.precision != precisionCountry || v.label != "Bob" {
+		t.Errorf("authorise = %+v, %t, want Bob with country scope", v, ok)
+	}
+
+	if err := mintLinkCommand([]string{"-share-key-path", keyPath}, &out); err == nil {
+		t.Error("expected error minting a link without a label")
+	}
+
+	if err := mintLinkCommand([]string{"-share-key-path", keyPath, "-label", "Bob", "-person", "../bob"}, &out); err == nil {
+		t.Error("expected error minting a link for an invalid person")
+	}
+}
+
+// ============================================================
+// Tailscale policy
+// ============================================================
+
+func TestNewTSIdentity(t *testing.T) {
+	id := newTSIdentity(&apitype.WhoIsResponse{
+		Node: &tailcfg.Node{
+			Name: "dashboard.tail1234.ts.net.",
+			Tags: []string{"tag:dashboard"},
+		},
+		UserProfile: &tailcfg.UserProfile{LoginName: "tagged-devices"},
+		CapMap: tailcfg.PeerCapMap{
+			"kradalby.no/cap/hvor": {`{"scopes": "city"}`},
+		},
+	})
+
+	if id.login != "tagged-devices" || !slices.Equal(id.tags, []string{"tag:dashboard"}) {
+		t.Errorf("identity = %+v", id)
+	}
+
+	if !slices.Equal(id.nodes, []string{"dashboard.tail1234.ts.net", "dashboard"}) {
+		t.Errorf("nodes = %v", id.nodes)
+	}
+
+	if got := id.caps["kradalby.no/cap/hvor"]; len(got) != 1 {
+		t.Errorf("caps = %v", id.caps)
+	}
+}
+
+func TestTSPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+
+	err := os.WriteFile(path, []byte(`{
+  "rules": [
+    {"nodes": ["kiosk"], "deny": true},
+    {"logins": ["me@example.com"]},
+    {"tags": ["tag:dashboard"], "scopes": "city"},
+    {"capabilities": ["kradalby.no/cap/hvor"], "scopes": "country"}
+  ]
+}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := loadTSPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		id   tsIdentity
+		want scope
+		ok   bool
+	}{
+		{"login", tsIdentity{login: "me@example.com"}, fullScope, true},
+		{"denied node", tsIdentity{login: "me@example.com", nodes: []string{"kiosk"}}, scope{}, false},
+		{"tag", tsIdentity{login: "tagged-devices", tags: []string{"tag:dashboard"}}, scope{precision: precisionCity}, true},
+		{
+			"grant without scopes",
+			tsIdentity{login: "friend@other.com", caps: map[string][]string{"kradalby.no/cap/hvor": {`{}`}}},
+			scope{precision: precisionCountry},
+			true,
+		},
+		{
+			"widest grant",
+			tsIdentity{login: "friend@other.com", caps: map[string][]string{"kradalby.no/cap/hvor": {
+				`{"scopes": "country+descriptions"}`,
+				`{"scopes": "city"}`,
+			}}},
+			scope{precision: precisionCity, descriptions: true},
+			true,
+		},
+		{"shared-in node", tsIdentity{login: "stranger@other.com", nodes: []string{"their-laptop"}}, scope{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := policy.scope(tt.id)
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("scope = %+v, %t, want %+v, %t", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+
+	policy.Default = "country"
+	if err := policy.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, ok := policy.scope(tsIdentity{login: "stranger@other.com"}); !ok || got.precision != precisionCountry {
+		t.Errorf("default = %+v, %t, want country", got, ok)
+	}
+
+	for _, bad := range []string{
+		`{"rules": [{"scopes": "city"}]}`,
+		`{"rules": [{"logins": ["me@example.com"], "scopes": "street"}]}`,
+		`{"default": "street"}`,
+	} {
+		if err := os.WriteFile(path, []byte(bad), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := loadTSPolicy(path); err == nil {
+			t.Errorf("expected error loading %s", bad)
+		}
+	}
+}
+
+// ============================================================
+// Sessions
+// ============================================================
+
+// withSession returns r with a session for the from token.
+func withSession(h *hvor, r *http.Request, token string) *http.Request {
+	r.AddCookie(h.sessionCookieFor(r, token, time.Now()))
+
+	return r
+}
+
+func TestSessionExchange(t *testing.T) {
+	now := time.Now()
+
+	cal := ics.NewCalendar()
+	addLocatedEvent(cal, "current", now.AddDate(0, 0, -1), now.AddDate(0, 0, 2), "Leiden")
+
+	h := testHvor(t, config{tokens: parseTokens("tok")})
+	if err := h.setCalendar(snapshot{calendars: []sourceCalendar{{url: "test", cal: cal}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The token is exchanged for a session and dropped from the URL.
+	w := httptest.NewRecorder()
+	h.handler().ServeHTTP(w, httptest.NewRequest("GET", "/?from=tok&utm=x", nil))
+
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/?utm=x" {
+		t.Fatalf("status = %d, Location = %q, want redirect to /?utm=x", w.Code, w.Header().Get("Location"))
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != sessionCookie || !cookies[0].HttpOnly {
+		t.Fatalf("cookies = %+v, want an HttpOnly session cookie", cookies)
+	}
+
+	for _, tt := range []struct {
+		handler http.Handler
+		target  string
+	}{
+		{h.handler(), "/"},
+		{h.future(), "/future?from=0&to=5"},
+		{h.past(), "/past?from=0&to=5"},
+		{h.whereaboutsHandler(), "/api/v1/whereabouts"},
+		{h.icsHandler(), "/ics"},
+		{h.exportHandler("geojson"), "/export/geojson"},
+	} {
+		r := httptest.NewRequest("GET", tt.target, nil)
+		w := httptest.NewRecorder()
+		tt.handler.ServeHTTP(w, r)
+
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s without session: status = %d, want %d", tt.target, w.Code, http.StatusUnauthorized)
+		}
+
+		r.AddCookie(cookies[0])
+		w = httptest.NewRecorder()
+		tt.handler.ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("%s with session: status = %d, want %d", tt.target, w.Code, http.StatusOK)
+		}
+	}
+
+	// Fragments do not take tokens, their from is for paging.
+	w = httptest.NewRecorder()
+	h.future().ServeHTTP(w, httptest.NewRequest("GET", "/future?from=tok&to=5", nil))
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("future with token: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	// Revoking the token ends the session.
+	h.conf.Store(&config{tokens: parseTokens("other")})
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	h.handler().ServeHTTP(w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("revoked token: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestSessionCookieTampering(t *testing.T) {
+	h := testHvor(t, config{tokens: parseTokens("tok,admin")})
+	now := time.Now()
+
+	r := httptest.NewRequest("GET", "/", nil)
+	c := h.sessionCookieFor(r, "tok", now)
+
+	r.AddCookie(c)
+
+	if token, _, ok := h.sessionToken(r, now); !ok || token != "tok" {
+		t.Errorf("sessionToken = %q, %t, want tok", token, ok)
+	}
+
+	if _, _, ok := h.sessionToken(r, now.Add(*sessionDuration+time.Minute)); ok {
+		t.Error("expired session accepted")
+	}
+
+	payload, sig, _ := strings.Cut(c.Value, ".")
+	forged := strings.Replace(payload, "dG9r", "YWRtaW4", 1)
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: forged + "." + sig})
+
+	if _, _, ok := h.sessionToken(r, now); ok {
+		t.Error("tampered session accepted")
+	}
+
+	other := &hvor{logf: t.Logf}
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(c)
+
+	if _, _, ok := other.sessionToken(r, now); ok {
+		t.Error("session signed with another key accepted")
+	}
+}
+
+// ============================================================
+// Audit log
+// ============================================================
+
+func TestAuditLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	l, err := openAuditLog(path, 200, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now().Truncate(time.Second)
+
+	for i := range 10 {
+		err := l.write(auditEntry{Time: start.Add(time.Duration(i) * time.Minute), Viewer: fmt.Sprintf("v%d", i), Route: "/"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("file %d: %s", i, err)
+		}
+
+		if info.Size() > 200 {
+			t.Errorf("%s is %d bytes, want at most 200", name, info.Size())
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); !errors.Is(err, os.ErrNotExist) {
+		t.Error("kept more rotated files than configured")
+	}
+
+	entries, err := l.entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) == 0 || entries[len(entries)-1].Viewer != "v9" {
+		t.Fatalf("entries = %+v, want the latest last", entries)
+	}
+
+	if !slices.IsSortedFunc(entries, func(a, b auditEntry) int { return a.Time.Compare(b.Time) }) {
+		t.Error("entries are not oldest first")
+	}
+
+	// Reopening appends.
+	l2, err := openAuditLog(path, 200, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if l2.size == 0 {
+		t.Error("reopened log does not know its size")
+	}
+}
+
+func TestRecordView(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	l, err := openAuditLog(path, 1<<20, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const token = "mum-s3cret-token"
+
+	h := testHvor(t, config{tokens: parseTokens(token + ",friend:city")})
+	h.audit = l
+	if err := h.setCalendar(snapshot{calendars: []sourceCalendar{{url: "test", cal: ics.NewCalendar()}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	label := tokenLabel(token)
+	before := testutil.ToFloat64(viewsTotal.WithLabelValues("/api/v1/whereabouts"))
+
+	for range 2 {
+		r := httptest.NewRequest("GET", "/api/v1/whereabouts?from="+token, nil)
+		r.Header.Set("User-Agent", "curl/8")
+		h.whereaboutsHandler().ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	h.whereaboutsHandler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/v1/whereabouts?from=dad", nil))
+
+	if got := testutil.ToFloat64(viewsTotal.WithLabelValues("/api/v1/whereabouts")) - before; got != 2 {
+		t.Errorf("views counted = %v, want 2", got)
+	}
+
+	entries, err := l.entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summaries := summariseViews(entries)
+	if len(summaries) != 1 || summaries[0].Viewer != label || summaries[0].Views != 2 || summaries[0].UserAgent != "curl/8" {
+		t.Errorf("summaries = %+v, want two views by %s", summaries, label)
+	}
+
+	// Only the full scope may see who else looks.
+	for from, want := range map[string]int{
+		"":       http.StatusUnauthorized,
+		"friend": http.StatusForbidden,
+	} {
+		w := httptest.NewRecorder()
+		h.auditHandler().ServeHTTP(w, httptest.NewRequest("GET", "/audit?from="+from, nil))
+
+		if w.Code != want {
+			t.Errorf("audit view with %q = %d, want %d", from, w.Code, want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	h.auditHandler().ServeHTTP(w, httptest.NewRequest("GET", "/audit?from="+token, nil))
+
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "curl/8") {
+		t.Errorf("audit view = %d, does not show the views", w.Code)
+	}
+
+	// Tokens without a label must not leak to who can read the audit log
+	// or scrape the metrics, and the metrics do not tell who views.
+	logged, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(metrics, httptest.NewRequest("GET", "/metrics", nil))
+
+	for name, out := range map[string]string{
+		"audit log":  string(logged),
+		"audit page": w.Body.String(),
+		"metrics":    metrics.Body.String(),
+	} {
+		if strings.Contains(out, token) {
+			t.Errorf("%s contains the token", name)
+		}
+	}
+
+	if strings.Contains(metrics.Body.String(), label) {
+		t.Error("metrics tell who viewed")
+	}
+}
+
+// ============================================================
+// Metrics
+// ============================================================
+
+func TestFetchResult(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{nil, "ok"},
+		{errNotModified, "not_modified"},
+		{fmt.Errorf("wrapped: %w", statusError{op: "calendar fetch", code: 503}), "http_503"},
+		{parseError{err: errors.New("bad")}, "parse_error"},
+		{errors.New("connection refused"), "error"},
+	}
+
+	for _, tt := range tests {
+		if got := fetchResult(tt.err); got != tt.want {
+			t.Errorf("fetchResult(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestFetchMetrics(t *testing.T) {
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status != http.StatusOK && r.URL.Path == "/failing.ics" {
+			w.WriteHeader(status)
+
+			return
+		}
+
+		_, _ = fmt.Fprint(w, validICS)
+	}))
+	defer ts.Close()
+
+	// Both calendars are on one host, so only their index tells them apart.
+	healthy, failing := sourceLabel(0, ts.URL+"/healthy.ics"), sourceLabel(1, ts.URL+"/failing.ics")
+	if healthy == failing {
+		t.Fatalf("sources share the label %q", healthy)
+	}
+
+	h := testHvor(t, config{
+		Sources: []string{ts.URL + "/healthy.ics", ts.URL + "/failing.ics"},
+		person:  person{ID: "alice"},
+	})
+
+	if err := h.updateCalendar(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, label := range []string{healthy, failing} {
+		if got := testutil.ToFloat64(fetchesTotal.WithLabelValues("alice", label, "ok")); got < 1 {
+			t.Errorf("ok fetches of %s = %v, want at least 1", label, got)
+		}
+
+		if got := testutil.ToFloat64(lastSuccess.WithLabelValues("alice", label)); got == 0 {
+			t.Errorf("last success timestamp of %s not set", label)
+		}
+	}
+
+	if got := testutil.ToFloat64(lastUpdate.WithLabelValues("alice")); got == 0 {
+		t.Error("last update timestamp not set for the person")
+	}
+
+	status = http.StatusBadGateway
+	before := testutil.ToFloat64(fetchesTotal.WithLabelValues("alice", failing, "http_502"))
+
+	if err := h.updateCalendar(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := testutil.ToFloat64(fetchesTotal.WithLabelValues("alice", failing, "http_502")) - before; got != 1 {
+		t.Errorf("http_502 fetches = %v, want 1", got)
+	}
+
+	if got := testutil.ToFloat64(fetchesTotal.WithLabelValues("alice", healthy, "http_502")); got != 0 {
+		t.Errorf("http_502 fetches of the healthy source = %v, want 0", got)
+	}
+}
+
+func TestInstrument(t *testing.T) {
+	handler := instrument("test", http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if got := testutil.ToFloat64(requestsTotal.WithLabelValues("test", "get", "418")); got != 1 {
+		t.Errorf("requests = %v, want 1", got)
+	}
+}
+
+// ============================================================
+// Health and readiness
+// ============================================================
+
+func TestRedactError(t *testing.T) {
+	src := "webcal://p01-caldav.icloud.com/published/2/SECRET"
+	msg := `Get "https://p01-caldav.icloud.com/published/2/SECRET": dial tcp: timeout`
+
+	got := redactError(msg, src)
+	if strings.Contains(got, "SECRET") {
+		t.Errorf("redactError = %q, leaks the secret", got)
+	}
+
+	if !strings.Contains(got, "p01-caldav.icloud.com") {
+		t.Errorf("redactError = %q, want the host kept", got)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	up := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if !up {
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+			return
+		}
+
+		_, _ = fmt.Fprint(w, validICS)
+	}))
+	defer ts.Close()
+
+	src := ts.URL + "/secret-calendar"
+	h := testHvor(t, config{Sources: []string{src}, Refresh: refreshConfig{ReadyPeriods: 2}, tokens: parseTokens("full,friend:city")})
+
+	getAt := func(handler http.Handler, target string) (int, readiness) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+
+		var ready readiness
+		_ = json.Unmarshal(w.Body.Bytes(), &ready)
+
+		return w.Code, ready
+	}
+
+	get := func(handler http.Handler) (int, readiness) {
+		return getAt(handler, "/readyz")
+	}
+
+	if code, ready := get(h.readyzHandler()); code != http.StatusServiceUnavailable || ready.Ready {
+		t.Errorf("without data: %d %+v, want not ready", code, ready)
+	}
+
+	if err := h.updateCalendar(); err != nil {
+		t.Fatal(err)
+	}
+
+	code, ready := get(h.readyzHandler())
+	if code != http.StatusOK || !ready.Ready || ready.Events != nil || ready.Sources != nil || ready.MaxAge != "" {
+		t.Errorf("fresh data: %d %+v, want only ready", code, ready)
+	}
+
+	code, ready = get(h.readinessHandler())
+	if code != http.StatusOK || !ready.Ready || ready.Events == nil || len(ready.Sources) != 1 {
+		t.Errorf("fresh data in detail: %d %+v, want ready with event counts and sources", code, ready)
+	}
+
+	// Without a debug handler, the detail is at /readyz?verbose for the
+	// full scope.
+	code, ready = getAt(h.readyzHandler(), "/readyz?verbose&from=full")
+	if code != http.StatusOK || ready.Events == nil || len(ready.Sources) != 1 {
+		t.Errorf("verbose: %d %+v, want ready in detail", code, ready)
+	}
+
+	for target, want := range map[string]int{
+		"/readyz?verbose":             http.StatusUnauthorized,
+		"/readyz?verbose&from=friend": http.StatusForbidden,
+	} {
+		if code, _ := getAt(h.readyzHandler(), target); code != want {
+			t.Errorf("%s = %d, want %d", target, code, want)
+		}
+	}
+
+	up = false
+	if err := h.updateCalendar(); err == nil {
+		t.Fatal("expected update to fail")
+	}
+
+	if code, ready := get(h.readyzHandler()); code != http.StatusOK || ready.LastError != "" {
+		t.Errorf("recent failure: %d %+v, want ready without the error", code, ready)
+	}
+
+	code, ready = get(h.readinessHandler())
+	if code != http.StatusOK || ready.LastError == "" {
+		t.Errorf("recent failure: %d %+v, want ready with the error", code, ready)
+	}
+
+	if strings.Contains(ready.LastError, "secret-calendar") {
+		t.Errorf("lastError = %q, leaks the calendar URL", ready.LastError)
+	}
+
+	if ready := h.readiness(time.Now().Add(3 * defaultRefreshPeriod)); ready.Ready {
+		t.Errorf("old data: %+v, want not ready", ready)
+	}
+
+	if code, _ := get(h.healthzHandler()); code != http.StatusOK {
+		t.Errorf("healthz = %d, want %d", code, http.StatusOK)
+	}
+}
+
+// ============================================================
+// Refresh
+// ============================================================
+
+func TestRefreshHandler(t *testing.T) {
+	h := testHvor(t, config{tokens: parseTokens("full,friend:city")})
+	h.refresh = make(chan struct{}, 1)
+
+	tests := []struct {
+		method, target string
+		want           int
+	}{
+		{"GET", "/refresh?from=full", http.StatusMethodNotAllowed},
+		{"POST", "/refresh", http.StatusUnauthorized},
+		{"POST", "/refresh?from=friend", http.StatusForbidden},
+		{"POST", "/refresh?from=full", http.StatusAccepted},
+		{"POST", "/refresh?from=full", http.StatusAccepted},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		h.refreshHandler().ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, nil))
+
+		if w.Code != tt.want {
+			t.Errorf("%s %s = %d, want %d", tt.method, tt.target, w.Code, tt.want)
+		}
+	}
+
+	// Both accepted requests are coalesced into a single pending refresh.
+	if len(h.refresh) != 1 {
+		t.Errorf("pending refreshes = %d, want 1", len(h.refresh))
+	}
+}
+
+func TestUpdaterRefresh(t *testing.T) {
+	fetched := make(chan struct{}, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fetched <- struct{}{}
+
+		_, _ = fmt.Fprint(w, validICS)
+	}))
+	defer ts.Close()
+
+	h := testHvor(t, config{
+		Sources: []string{ts.URL},
+		Refresh: refreshConfig{Period: duration(time.Hour)},
+	})
+	h.refresh = make(chan struct{}, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go h.updater(ctx)
+
+	h.triggerRefresh()
+
+	select {
+	case <-fetched:
+	case <-time.After(5 * time.Second):
+		t.Fatal("refresh did not fetch the calendar")
+	}
+
+	// The snapshot is stored after the fetch returns.
+	for deadline := time.Now().Add(5 * time.Second); h.snap.Load() == nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("refresh did not update the snapshot")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFirstUpdate(t *testing.T) {
+	h := testHvor(t, config{Refresh: refreshConfig{Period: duration(time.Hour)}})
+
+	if failures, wait := h.firstUpdate(); failures != 1 || wait > minBackoff {
+		t.Errorf("without a page = %d, %s, want a retry within %s", failures, wait, minBackoff)
+	}
+
+	h.snap.Store(&snapshot{calPage: &page{}, stale: true})
+
+	if failures, wait := h.firstUpdate(); failures != 1 || wait > minBackoff {
+		t.Errorf("serving a snapshot = %d, %s, want a retry within %s", failures, wait, minBackoff)
+	}
+
+	h.snap.Store(&snapshot{calPage: &page{}})
+
+	if failures, wait := h.firstUpdate(); failures != 0 || wait != time.Hour {
+		t.Errorf("fresh = %d, %s, want the period", failures, wait)
+	}
+}
+
+// ============================================================
+// Live updates
+// ============================================================
+
+func TestBroadcaster(t *testing.T) {
+	var b broadcaster
+
+	ch := b.subscribe()
+
+	// Notifications coalesce while the subscriber is busy.
+	b.notify()
+	b.notify()
+
+	if len(ch) != 1 {
+		t.Fatalf("pending notifications = %d, want 1", len(ch))
+	}
+
+	<-ch
+	b.unsubscribe(ch)
+	b.notify()
+
+	if len(ch) != 0 {
+		t.Errorf("notified after unsubscribing")
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+	now := time.Now()
+
+	calendar := func(summary string) snapshot {
+		cal := ics.NewCalendar()
+		addLocatedEvent(cal, "current", now.AddDate(0, 0, -1), now.AddDate(0, 0, 2), summary)
+
+		return snapshot{calendars: []sourceCalendar{{url: "test", cal: cal}}}
+	}
+
+	h := testHvor(t, config{tokens: parseTokens("tok")})
+	if err := h.setCalendar(calendar("Conference")); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(h.eventsHandler())
+	defer ts.Close()
+
+	// A stream cannot be opened with a token, as htmx cannot add one.
+	resp, err := http.Get(ts.URL + "?from=tok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("status with token = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	req := withSession(h, httptest.NewRequest("GET", ts.URL, nil), "tok")
+	req.RequestURI = ""
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q, want text/event-stream", ct)
+	}
+
+	// An identical rebuild is not pushed, so the first event carries the
+	// changed page.
+	if err := h.setCalendar(calendar("Conference")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.setCalendar(calendar("Holiday")); err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan string, 1)
+
+	go func() {
+		var event strings.Builder
+
+		br := bufio.NewReader(resp.Body)
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil || line == "\n" {
+				break
+			}
+
+			event.WriteString(line)
+		}
+
+		events <- event.String()
+	}()
+
+	var got string
+
+	select {
+	case got = <-events:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event after the page changed")
+	}
+
+	name, data, ok := strings.Cut(got, "\n")
+	if !ok || name != "event: current" {
+		t.Fatalf("stream = %q, want a current event", got)
+	}
+
+	if !strings.Contains(data, "Holiday") || strings.Contains(data, "Conference") {
+		t.Errorf("first event = %q, want the Holiday fragment", data)
+	}
+
+	for line := range strings.SplitSeq(strings.TrimSpace(data), "\n") {
+		if line != "" && !strings.HasPrefix(line, "data: ") {
+			t.Errorf("line %q is not a data field", line)
+
+			break
+		}
+	}
+}
+
+func TestEventsHandlerEnds(t *testing.T) {
+	now := time.Now()
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	writeTokenStore(t, path, []storedToken{{Token: "brief", Label: "Visitor", Expires: now.Add(500 * time.Millisecond)}}, now)
+
+	store, err := newTokenStore(path, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := testHvor(t, config{tokens: parseTokens("tok")})
+	h.tokenStore = store
+	if err := h.setCalendar(snapshot{calendars: []sourceCalendar{{url: "test", cal: ics.NewCalendar()}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(h.eventsHandler())
+	defer ts.Close()
+
+	// stream opens a stream with a session for token, and returns a
+	// channel closed when the server ends it.
+	stream := func(token string) <-chan struct{} {
+		req := withSession(h, httptest.NewRequest("GET", ts.URL, nil), token)
+		req.RequestURI = ""
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("stream for %s = %d, want %d", token, resp.StatusCode, http.StatusOK)
+		}
+
+		done := make(chan struct{})
+
+		go func() {
+			defer close(done)
+			defer func() { _ = resp.Body.Close() }()
+
+			_, _ = io.Copy(io.Discard, resp.Body)
+		}()
+
+		return done
+	}
+
+	ended := func(done <-chan struct{}, why string) {
+		t.Helper()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Errorf("stream not ended when %s", why)
+		}
+	}
+
+	// A link expiring ends the stream without waiting for a change.
+	ended(stream("brief"), "the link expired")
+
+	// A token removed from the config ends the stream on the next change.
+	done := stream("tok")
+
+	h.conf.Store(&config{})
+	h.live.notify()
+
+	ended(done, "the token was removed")
+}
+
+func TestHvorPageLive(t *testing.T) {
+	body := hvorPage(&page{}, person{}, nil, "", freshness{}).Render()
+
+	for _, want := range []string{`sse-connect="/events"`, `sse-swap="current"`, "Unknown whereabouts"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("page is missing %s", want)
+		}
+	}
+}
+
+// ============================================================
+// Config
+// ============================================================
+
+func TestParseConfig(t *testing.T) {
+	base := config{
+		Sources: []string{"https://example.com/base.ics"},
+		Map:     mapConfig{Provider: "mapbox", Token: "flag-token"},
+		tokens:  parseTokens("flag"),
+	}
+
+	cfg, err := parseConfig([]byte(`{
+		// Comments and trailing commas are fine.
+		"sources": ["https://example.com/a.ics", "caldavs://dav.example.com/home/"],
+		"tokens": [{"token": "mum"}, {"token": "friend", "scopes": "city"}],
+		"display": {"monthsFuture": 12},
+		"refresh": {"period": "5m"},
+	}`), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cfg.Sources) != 2 || cfg.Sources[0] != "https://example.com/a.ics" {
+		t.Errorf("Sources = %v", cfg.Sources)
+	}
+
+	// Settings missing from the file keep the flag values.
+	if cfg.Map.Token != "flag-token" {
+		t.Errorf("Map.Token = %q, want the flag value", cfg.Map.Token)
+	}
+
+	if _, ok := cfg.tokens.scope("flag"); ok {
+		t.Error("tokens from the file should replace the flag tokens")
+	}
+
+	if sc, ok := cfg.tokens.scope("friend"); !ok || sc.precision != precisionCity {
+		t.Errorf("friend scope = %+v, %v, want city", sc, ok)
+	}
+
+	if w := cfg.window(); w != (window{past: defaultMonthsPast, future: 12}) {
+		t.Errorf("window = %+v", w)
+	}
+
+	if time.Duration(cfg.Refresh.Period) != 5*time.Minute {
+		t.Errorf("Refresh.Period = %s, want 5m", time.Duration(cfg.Refresh.Period))
+	}
+
+	// The base is not modified.
+	if base.Sources[0] != "https://example.com/base.ics" {
+		t.Errorf("base sources changed to %v", base.Sources)
+	}
+
+	// Without tokens in the file, the flag tokens are kept.
+	cfg, err = parseConfig([]byte(`{"display": {"icsDescriptions": true}}`), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := cfg.tokens.scope("flag"); !ok || !cfg.Display.ICSDescriptions {
+		t.Errorf("config = %+v, want flag tokens and ICS descriptions", cfg)
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	base := config{Sources: []string{"https://example.com/a.ics"}}
+
+	tests := []struct {
+		name, config, want string
+	}{
+		{"syntax", `{"sources": [}`, "failed to parse config"},
+		{"unknown field", `{"soruces": []}`, `unknown field "soruces"`},
+		{"no sources", `{"sources": []}`, "sources: no calendar sources"},
+		{"scheme", `{"sources": ["ftp://example.com/a.ics"]}`, `sources[0]: unsupported calendar source scheme "ftp"`},
+		{"empty token", `{"tokens": [{"token": ""}]}`, "tokens[0]: empty token"},
+		{"duplicate token", `{"tokens": [{"token": "a"}, {"token": "a"}]}`, "tokens[1]: duplicate token"},
+		{"scope", `{"tokens": [{"token": "a", "scopes": "everything"}]}`, `tokens[0]: unknown scope "everything"`},
+		{"provider", `{"map": {"provider": "google"}}`, `map.provider: unsupported provider "google"`},
+		{"months", `{"display": {"monthsPast": -1}}`, "display: months must not be negative"},
+		{"duration", `{"refresh": {"period": "often"}}`, "failed to decode config"},
+		{"period", `{"refresh": {"period": "1s"}}`, "refresh.period: must be at least"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseConfig([]byte(tt.config), base)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	now := time.Now()
+
+	cal := ics.NewCalendar()
+	addAllDayEvent(cal, "soon", now.AddDate(0, 2, 0), now.AddDate(0, 2, 1), "Soon")
+	addAllDayEvent(cal, "later", now.AddDate(0, 5, 0), now.AddDate(0, 5, 1), "Later")
+
+	calPath := filepath.Join(t.TempDir(), "calendar.ics")
+	if err := os.WriteFile(calPath, []byte(cal.Serialize()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "hvor.hujson")
+	write := func(content string) {
+		t.Helper()
+
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(fmt.Sprintf(`{"sources": [%q], "tokens": [{"token": "tok"}]}`, calPath))
+
+	h := &hvor{configPath: path, logf: t.Logf}
+	if err := h.reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.updateCalendar(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := len(h.snap.Load().calPage.Future); got != 1 {
+		t.Fatalf("future events = %d, want 1 within the default window", got)
+	}
+
+	// A broken file keeps the config in use.
+	write(`{"sources": [`)
+
+	if err := h.reloadConfig(); err == nil {
+		t.Fatal("expected reloading a broken config to fail")
+	}
+
+	if _, ok := h.config().tokens.scope("tok"); !ok {
+		t.Fatal("the config in use was dropped")
+	}
+
+	// A wider window rebuilds the page though the calendar is unchanged.
+	write(fmt.Sprintf(`{"sources": [%q], "display": {"monthsFuture": 6}}`, calPath))
+
+	if err := h.reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.updateCalendar(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := len(h.snap.Load().calPage.Future); got != 2 {
+		t.Errorf("future events = %d, want 2 after widening the window", got)
+	}
+}
+
+// ============================================================
+// Teams
+// ============================================================
+
+func TestParseConfigPeople(t *testing.T) {
+	cfg, err := parseConfig([]byte(`{
+		"tokens": [{"token": "team", "scopes": "city"}],
+		"people": [
+			{"id": "alice", "name": "Alice", "sources": ["/a.ics"], "tokens": [{"token": "mum"}], "caldavCredentials": "/alice"},
+			{"id": "bob", "sources": ["/b.ics"]},
+		],
+	}`), config{CalDAVCredentials: "/team"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := cfg.forPerson(cfg.People[0])
+	if alice.person != (person{ID: "alice", Name: "Alice"}) || alice.Sources[0] != "/a.ics" {
+		t.Errorf("alice = %+v", alice)
+	}
+
+	if _, ok := alice.tokens.scope("mum"); !ok {
+		t.Error("alice should have her own tokens")
+	}
+
+	if sc, ok := alice.tokens.scope("team"); !ok || sc.precision != precisionCity {
+		t.Error("alice should have the team tokens")
+	}
+
+	bob := cfg.forPerson(cfg.People[1])
+	if _, ok := bob.tokens.scope("mum"); ok {
+		t.Error("bob should not have the tokens of alice")
+	}
+
+	if bob.person.Name != "bob" {
+		t.Errorf("bob is named %q, want the id", bob.person.Name)
+	}
+
+	if alice.CalDAVCredentials != "/alice" || bob.CalDAVCredentials != "/team" {
+		t.Errorf("caldav credentials = %q and %q, want their own or the team ones", alice.CalDAVCredentials, bob.CalDAVCredentials)
+	}
+
+	tests := []struct {
+		name, people, want string
+	}{
+		{"id", `[{"id": "Alice", "sources": ["/a.ics"]}]`, `people[0].id: "Alice" must be`},
+		{"reserved", `[{"id": "static", "sources": ["/a.ics"]}]`, `"static" is used by hvor itself`},
+		{"duplicate", `[{"id": "a", "sources": ["/a.ics"]}, {"id": "a", "sources": ["/b.ics"]}]`, `people[1].id: duplicate id "a"`},
+		{"sources", `[{"id": "a"}]`, "people[0].sources: no calendar sources"},
+		{"tokens", `[{"id": "a", "sources": ["/a.ics"], "tokens": [{"token": "x", "scopes": "all"}]}]`, "people[0].tokens[0]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseConfig([]byte(`{"people": `+tt.people+`}`), config{})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTeam(t *testing.T) {
+	now := time.Now()
+	dir := t.TempDir()
+
+	source := func(name, summary string) string {
+		cal := ics.NewCalendar()
+		addLocatedEvent(cal, "current", now.AddDate(0, 0, -1), now.AddDate(0, 0, 2), summary)
+
+		path := filepath.Join(dir, name+".ics")
+		if err := os.WriteFile(path, []byte(cal.Serialize()), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		return path
+	}
+
+	alice, bob := source("alice", "Leiden"), source("bob", "Tromsø")
+
+	path := filepath.Join(dir, "hvor.hujson")
+	write := func(people string) {
+		t.Helper()
+
+		content := fmt.Sprintf(`{"tokens": [{"token": "team"}], "people": %s}`, people)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(fmt.Sprintf(`[
+		{"id": "alice", "name": "Alice", "sources": [%q], "tokens": [{"token": "mum"}]},
+		{"id": "bob", "name": "Bob", "sources": [%q]},
+	]`, alice, bob))
+
+	// Share links and stored tokens are shared by the team, but can be
+	// for one person.
+	key := []byte(strings.Repeat("k", minShareKeyLength))
+	storePath := filepath.Join(dir, "tokens.json")
+	writeTokenStore(t, storePath, []storedToken{{Token: "stored-for-alice", Label: "Friend", Person: "alice"}}, now)
+
+	store, err := newTokenStore(storePath, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &hvor{configPath: path, shareKey: key, tokenStore: store, logf: t.Logf}
+	if err := h.reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tm := newTeam(h)
+	tm.sync(ctx)
+
+	get := func(target string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+
+		w := httptest.NewRecorder()
+		tm.ServeHTTP(w, r)
+
+		return w
+	}
+
+	// The index takes team-wide tokens only, and lists everyone.
+	if w := get("/?from=mum"); w.Code != http.StatusUnauthorized {
+		t.Errorf("index with a personal token = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	w := get("/", h.sessionCookieFor(httptest.NewRequest("GET", "/", nil), "team", now))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `href="/alice/"`) || !strings.Contains(w.Body.String(), "Bob") {
+		t.Fatalf("index = %d, %s", w.Code, w.Body.String())
+	}
+
+	// A personal token starts a session for that person only.
+	w = get("/alice/?from=mum")
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("alice with her token = %d, want %d", w.Code, http.StatusSeeOther)
+	}
+
+	session := w.Result().Cookies()[0]
+	if session.Path != "/alice/" {
+		t.Errorf("session path = %q, want /alice/", session.Path)
+	}
+
+	w = get("/alice/", session)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Leiden") || !strings.Contains(w.Body.String(), `sse-connect="/alice/events"`) {
+		t.Errorf("alice = %d, want her page", w.Code)
+	}
+
+	if w := get("/bob/?from=mum"); w.Code != http.StatusUnauthorized {
+		t.Errorf("bob with the token of alice = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	if w := get("/bob/api/v1/whereabouts?from=team"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Tromsø") {
+		t.Errorf("bob with the team token = %d, %s", w.Code, w.Body.String())
+	}
+
+	link, err := mintShareLink(key, "Friend", "", "alice", now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	everyone, err := mintShareLink(key, "Friend", "", "", now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		target string
+		want   int
+	}{
+		{"/alice/api/v1/whereabouts?from=" + link, http.StatusOK},
+		{"/bob/api/v1/whereabouts?from=" + link, http.StatusForbidden},
+		{"/bob/?from=" + link, http.StatusForbidden},
+		{"/bob/ics?from=" + link, http.StatusForbidden},
+		{"/?from=" + link, http.StatusForbidden},
+		{"/alice/api/v1/whereabouts?from=stored-for-alice", http.StatusOK},
+		{"/bob/api/v1/whereabouts?from=stored-for-alice", http.StatusForbidden},
+		{"/bob/api/v1/whereabouts?from=" + everyone, http.StatusOK},
+		{"/audit?from=mum", http.StatusUnauthorized},
+		{"/audit?from=stored-for-alice", http.StatusForbidden},
+		{"/audit?from=team", http.StatusNotFound},
+	} {
+		if w := get(tt.target); w.Code != tt.want {
+			t.Errorf("%s = %d, want %d", tt.target, w.Code, tt.want)
+		}
+	}
+
+	if w := get("/carol/"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown person = %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	// Readiness of everyone is public, but not the detail of anyone.
+	w = httptest.NewRecorder()
+	tm.readyzHandler().ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"ready":true}` {
+		t.Errorf("readyz = %d, %s, want only ready", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	tm.readinessHandler().ServeHTTP(w, httptest.NewRequest("GET", "/debug/readiness", nil))
+
+	if !strings.Contains(w.Body.String(), `"alice"`) || !strings.Contains(w.Body.String(), `"events"`) {
+		t.Errorf("readiness = %s, want the detail of everyone", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	tm.readyzHandler().ServeHTTP(w, httptest.NewRequest("GET", "/readyz?verbose&from=team", nil))
+
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"alice"`) {
+		t.Errorf("verbose readyz = %d, %s, want the detail of everyone", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	tm.readyzHandler().ServeHTTP(w, httptest.NewRequest("GET", "/readyz?verbose&from=stored-for-alice", nil))
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("verbose readyz for alice only = %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	// People can be removed, and added, without a restart.
+	write(fmt.Sprintf(`[{"id": "carol", "sources": [%q]}]`, bob))
+
+	if err := h.reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	tm.sync(ctx)
+
+	if w := get("/bob/?from=team"); w.Code != http.StatusNotFound {
+		t.Errorf("removed person = %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	if w := get("/carol/api/v1/whereabouts?from=team"); w.Code != http.StatusOK {
+		t.Errorf("added person = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+// ============================================================
+// Team overview
+// ============================================================
+
+func TestLocalZone(t *testing.T) {
+	now := time.Now()
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skip("no time zone database")
+	}
+
+	located := func(lon string) *appleLocation {
+		return &appleLocation{Title: "Somewhere", Latitude: "0", Longitude: lon}
+	}
+
+	tests := []struct {
+		name string
+		page page
+		want string
+	}{
+		{"nowhere", page{}, ""},
+		{"timed event", page{Current: &pageEvent{From: now.In(tokyo), Location: located("4.5")}}, "Asia/Tokyo"},
+		{"concurrent timed event", page{
+			Current:    &pageEvent{From: now, AllDay: true, Location: located("4.5")},
+			Concurrent: pageEvents{{From: now.In(tokyo)}},
+		}, "Asia/Tokyo"},
+		{"longitude", page{Current: &pageEvent{From: now, AllDay: true, Location: located("139.7")}}, "UTC+9"},
+		{"west", page{Current: &pageEvent{From: now.UTC(), Location: located("-74.0")}}, "UTC-5"},
+		{"no location", page{Current: &pageEvent{From: now, AllDay: true}}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ""
+			if loc := localZone(&tt.page); loc != nil {
+				got = loc.String()
+			}
+
+			if got != tt.want {
+				t.Errorf("localZone = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextTrip(t *testing.T) {
+	p := &page{Future: pageEvents{
+		{Summary: "Dentist"},
+		{Summary: "Oslo", Location: &appleLocation{Title: "Oslo"}},
+	}}
+
+	if got := nextTrip(p); got == nil || got.Summary != "Oslo" {
+		t.Errorf("nextTrip = %+v, want Oslo", got)
+	}
+
+	p.Future = p.Future[:1]
+	if got := nextTrip(p); got == nil || got.Summary != "Dentist" {
+		t.Errorf("nextTrip without locations = %+v, want Dentist", got)
+	}
+
+	if got := nextTrip(&page{}); got != nil {
+		t.Errorf("nextTrip of nothing = %+v", got)
+	}
+}
+
+func TestOverview(t *testing.T) {
+	now := time.Now()
+	dir := t.TempDir()
+
+	cal := ics.NewCalendar()
+	addLocatedEvent(cal, "current", now.AddDate(0, 0, -1), now.AddDate(0, 0, 2), "Leiden")
+	addLocatedEvent(cal, "next", now.AddDate(0, 0, 10), now.AddDate(0, 0, 12), "Oslo")
+
+	located := filepath.Join(dir, "alice.ics")
+	if err := os.WriteFile(located, []byte(cal.Serialize()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	empty := filepath.Join(dir, "bob.ics")
+	if err := os.WriteFile(empty, []byte(validICS), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "hvor.hujson")
+	content := fmt.Sprintf(`{
+		"tokens": [{"token": "team"}, {"token": "far", "scopes": "country"}],
+		"people": [
+			{"id": "alice", "name": "Alice", "sources": [%q]},
+			{"id": "bob", "name": "Bob", "sources": [%q]},
+		],
+	}`, located, empty)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Share links and stored tokens are shared by the team, but can be
+	// for one person.
+	key := []byte(strings.Repeat("k", minShareKeyLength))
+	storePath := filepath.Join(dir, "tokens.json")
+	writeTokenStore(t, storePath, []storedToken{{Token: "stored-for-alice", Label: "Friend", Person: "alice"}}, now)
+
+	store, err := newTokenStore(storePath, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &hvor{configPath: path, shareKey: key, tokenStore: store, logf: t.Logf}
+	if err := h.reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tm := newTeam(h)
+	tm.sync(ctx)
+
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		tm.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+
+		return w
+	}
+
+	w := get("/api/v1/overview?from=team")
+	if w.Code != http.StatusOK {
+		t.Fatalf("overview = %d, %s", w.Code, w.Body.String())
+	}
+
+	var o overview
+	if err := json.Unmarshal(w.Body.Bytes(), &o); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(o.People) != 2 || o.People[0].ID != "alice" || o.People[1].Name != "Bob" {
+		t.Fatalf("people = %+v", o.People)
+	}
+
+	alice := o.People[0]
+	if alice.Current == nil || alice.Current.Location.Title != "Leiden" {
+		t.Errorf("alice current = %+v, want Leiden", alice.Current)
+	}
+
+	if alice.Next == nil || alice.Next.Summary != "Oslo" {
+		t.Errorf("alice next = %+v, want Oslo", alice.Next)
+	}
+
+	if alice.TimeZone != "UTC+0" || alice.LocalTime.IsZero() {
+		t.Errorf("alice local time = %s in %q, want UTC+0 from the longitude of Leiden", alice.LocalTime, alice.TimeZone)
+	}
+
+	if bob := o.People[1]; bob.Current != nil || bob.TimeZone != "" {
+		t.Errorf("bob = %+v, want unknown whereabouts", bob)
+	}
+
+	// The overview is restricted like the pages of everyone.
+	w = get("/api/v1/overview?from=far")
+	if err := json.Unmarshal(w.Body.Bytes(), &o); err != nil {
+		t.Fatal(err)
+	}
+
+	if lat := o.People[0].Current.Location.Latitude; lat == nil || *lat != 52 {
+		t.Errorf("latitude for a country scope = %v, want 52", lat)
+	}
+
+	w = get("/overview?from=team")
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("overview page = %d, want a redirect to start a session", w.Code)
+	}
+
+	r := httptest.NewRequest("GET", "/overview", nil)
+	r.AddCookie(w.Result().Cookies()[0])
+
+	w = httptest.NewRecorder()
+	tm.ServeHTTP(w, r)
+
+	body := w.Body.String()
+	for _, want := range []string{`"name":"Alice"`, "Leiden", "Next: Oslo", "Unknown whereabouts", `href="/bob/"`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("overview page is missing %s", want)
+		}
+	}
+
+	if w := get("/api/v1/elsewhere?from=team"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown team route = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+// ============================================================
+// Co-location
+// ============================================================
+
+func TestHaversine(t *testing.T) {
+	// Oslo to Bergen is about 305 km as the crow flies.
+	if d := haversine(59.9139, 10.7522, 60.3913, 5.3221); math.Abs(d-305) > 5 {
+		t.Errorf("Oslo to Bergen = %.0f km, want about 305", d)
+	}
+
+	if d := haversine(52.16, 4.497, 52.16, 4.497); d != 0 {
+		t.Errorf("distance to itself = %f", d)
+	}
+}
+
+func TestFindColocations(t *testing.T) {
+	day := time.Date(2026, 11, 2, 0, 0, 0, 0, time.UTC)
+
+	at := func(summary, lat, lon string, from, to int) pageEvent {
+		return pageEvent{
+			Summary:  summary,
+			From:     day.AddDate(0, 0, from),
+			To:       day.AddDate(0, 0, to),
+			AllDay:   true,
+			Location: &appleLocation{Title: summary, Latitude: lat, Longitude: lon},
+		}
+	}
+
+	people := map[string]*page{
+		"alice": {
+			Current: &pageEvent{Summary: "Home", From: day.AddDate(0, 0, -3), To: day},
+			Future: pageEvents{
+				at("Oslo", "59.9139", "10.7522", 0, 5),
+				at("Bergen", "60.3913", "5.3221", 10, 12),
+			},
+		},
+		"bob": {
+			Future: pageEvents{
+				// Lysaker is a few km from central Oslo.
+				at("Lysaker", "59.9133", "10.6387", 3, 8),
+				at("Bergen", "60.3913", "5.3221", 12, 14),
+			},
+		},
+		"carol": {
+			Concurrent: pageEvents{at("Bergen", "60.39", "5.32", 0, 20)},
+		},
+	}
+
+	watch := []watchLocation{{Name: "Oslo office", Latitude: 59.91, Longitude: 10.75}}
+
+	got := findColocations(people, watch, 50)
+
+	want := []string{
+		"alice|Oslo office|20261102|20261107",
+		"alice,bob||20261105|20261107",
+		"bob|Oslo office|20261105|20261110",
+		"alice,carol||20261112|20261114",
+		"bob,carol||20261114|20261116",
+	}
+
+	var keys []string
+	for _, c := range got {
+		keys = append(keys, c.key())
+	}
+
+	if !slices.Equal(keys, want) {
+		t.Fatalf("colocations =\n%s\nwant\n%s", strings.Join(keys, "\n"), strings.Join(want, "\n"))
+	}
+
+	// Bob arrives in Bergen as Alice leaves, so they are not there together.
+	for _, c := range got {
+		if c.Where == "Bergen" && slices.Equal(c.People, []string{"alice", "bob"}) {
+			t.Errorf("back to back stays overlap: %+v", c)
+		}
+	}
+
+	if c := got[1]; c.Where != "Oslo" || c.Distance != 6 {
+		t.Errorf("alice and bob = %+v, want 6 km from Oslo", c)
+	}
+
+	if got := findColocations(people, nil, 1); len(got) != 2 || got[0].Where != "Bergen" {
+		t.Errorf("within 1 km = %+v, want only Bergen", got)
+	}
+
+	// Leiden and Amsterdam are about 36 km apart, but as areas of 20 km
+	// they touch.
+	leiden := at("Leiden", "52.1601", "4.4970", 0, 3)
+	leiden.Location.Radius = 20_000
+	amsterdam := at("Amsterdam", "52.3676", "4.9041", 1, 4)
+	amsterdam.Location.Radius = 20_000
+
+	areas := map[string]*page{"alice": {Future: pageEvents{leiden}}, "bob": {Future: pageEvents{amsterdam}}}
+	if got := findColocations(areas, nil, 10); len(got) != 1 || got[0].Distance != 36 {
+		t.Errorf("areas = %+v, want them matched 36 km apart", got)
+	}
+
+	leiden.Location.Radius, amsterdam.Location.Radius = 0, 0
+	if got := findColocations(areas, nil, 10); len(got) != 0 {
+		t.Errorf("points = %+v, want no match", got)
+	}
+}
+
+func TestColocationConfig(t *testing.T) {
+	base := config{Sources: []string{"https://example.com/a.ics"}}
+
+	_, err := parseConfig([]byte(`{"colocation": {
+		"distance": -1,
+		"watch": [{"name": "", "latitude": 91}],
+	}}`), base)
+
+	for _, want := range []string{
+		"colocation.distance: must not be negative",
+		"colocation.watch[0]: no name",
+		"colocation.watch[0]: coordinates out of range",
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("err = %v, want it to contain %q", err, want)
+		}
+	}
+
+	cfg, err := parseConfig([]byte(`{"colocation": {"watch": [{"name": "Office", "latitude": 59.91, "longitude": 10.75}]}}`), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d := cfg.Colocation.distance(); d != defaultColocationDistance {
+		t.Errorf("distance = %f, want the default", d)
+	}
+}
+
+func TestNearby(t *testing.T) {
+	now := time.Now()
+
+	cal := ics.NewCalendar()
+	addLocatedEvent(cal, "current", now.AddDate(0, 0, -1), now.AddDate(0, 0, 2), "Leiden")
+
+	h := testHvor(t, config{
+		tokens: parseTokens("tok"),
+		Colocation: colocationConfig{
+			Watch: []watchLocation{
+				{Name: "Leiden University", Latitude: 52.1572, Longitude: 4.4854},
+				{Name: "Oslo office", Latitude: 59.91, Longitude: 10.75},
+			},
+		},
+	})
+	if err := h.setCalendar(snapshot{calendars: []sourceCalendar{{url: "test", cal: cal}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	h.whereaboutsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/whereabouts?from=tok", nil))
+
+	var got whereabouts
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got.Nearby) != 1 || got.Nearby[0].Watch != "Leiden University" || got.Nearby[0].People != nil {
+		t.Fatalf("nearby = %+v, want Leiden University", got.Nearby)
+	}
+
+	w = httptest.NewRecorder()
+	h.handler().ServeHTTP(w, withSession(h, httptest.NewRequest("GET", "/", nil), "tok"))
+
+	if body := w.Body.String(); !strings.Contains(body, "Nearby") || !strings.Contains(body, "Leiden University, ") {
+		t.Error("page does not show that Leiden University is nearby")
+	}
+}
+
+func TestColocationWebhooks(t *testing.T) {
+	u, received := webhookReceiver(t, 0)
+
+	h := testHvor(t, config{
+		Webhooks: []webhookConfig{
+			{URL: u + "/team", Format: "ntfy", scope: fullScope},
+			{URL: u + "/arrivals", Events: []changeKind{changeArrived}, scope: fullScope},
+		},
+	})
+	h.webhooks = newWebhookQueue(t.Context(), t.Logf)
+
+	start := time.Now().AddDate(0, 0, 10)
+
+	member := func(id, name string, located bool) *hvor {
+		m := testHvor(t, config{person: person{ID: id, Name: name}})
+
+		cal := ics.NewCalendar()
+		if located {
+			addLocatedEvent(cal, id, start, start.AddDate(0, 0, 3), "Leiden")
+		}
+
+		if err := m.setCalendar(snapshot{calendars: []sourceCalendar{{url: "test", cal: cal}}}); err != nil {
+			t.Fatal(err)
+		}
+
+		return m
+	}
+
+	alice, bob := member("alice", "Alice", true), member("bob", "", false)
+	told := make(map[string]map[string]bool)
+
+	// The first check only learns what is already known.
+	h.checkColocations([]*hvor{alice, bob}, told)
+
+	bob = member("bob", "", true)
+	h.checkColocations([]*hvor{alice, bob}, told)
+	h.checkColocations([]*hvor{alice, bob}, told)
+
+	select {
+	case r := <-received:
+		if r.path != "/team" || r.title != "Co-location" || !strings.HasPrefix(r.body, "Alice and bob: Leiden, ") {
+			t.Errorf("received %+v, want Alice and bob in Leiden", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the co-location")
+	}
+
+	select {
+	case r := <-received:
+		t.Errorf("unexpected webhook %+v", r)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// ============================================================
+// Webhooks
+// ============================================================
+
+func TestDiffPages(t *testing.T) {
+	now := time.Date(2026, 11, 2, 12, 0, 0, 0, time.UTC)
+	horizon := now.AddDate(0, 3, 0)
+
+	ev := func(uid, summary string, from, to int) pageEvent {
+		return pageEvent{
+			UID:      uid,
+			Summary:  summary,
+			From:     now.AddDate(0, 0, from),
+			To:       now.AddDate(0, 0, to),
+			Location: &appleLocation{Title: summary, Latitude: "1", Longitude: "2"},
+		}
+	}
+
+	home := ev("home", "Leiden", -10, 1)
+	oslo := ev("oslo", "Oslo", 5, 8)
+	weekly := []pageEvent{ev("weekly", "Gym", 7, 8), ev("weekly", "Gym", 14, 15)}
+
+	prev := &page{
+		Current: &home,
+		Past:    pageEvents{ev("old", "Paris", -40, -30)},
+		Future:  pageEvents{oslo, weekly[0], weekly[1], ev("rome", "Rome", 20, 25)},
+	}
+
+	bergen := ev("bergen", "Bergen", 30, 32)
+	movedOslo := ev("oslo", "Oslo", 6, 9)
+	current := ev("rome", "Rome", -1, 3)
+
+	tests := []struct {
+		name string
+		next *page
+		want []string
+	}{
+		{
+			name: "unchanged",
+			next: prev,
+		},
+		{
+			name: "added, moved and cancelled",
+			next: &page{
+				Current: &home,
+				Past:    pageEvents{ev("old", "Paris", -40, -30)},
+				Future:  pageEvents{movedOslo, weekly[0], bergen, ev("far", "Tokyo", 100, 102)},
+			},
+			want: []string{"moved Oslo", "cancelled Gym", "cancelled Rome", "added Bergen"},
+		},
+		{
+			name: "arrived early",
+			next: &page{
+				Current: &current,
+				Past:    pageEvents{home},
+				Future:  pageEvents{oslo, weekly[0], weekly[1]},
+			},
+			want: []string{"arrived Rome", "moved Rome"},
+		},
+		{
+			name: "past event dropped",
+			next: &page{
+				Current: &home,
+				Future:  pageEvents{oslo, weekly[0], weekly[1], ev("rome", "Rome", 20, 25)},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, c := range diffPages(prev, tt.next, now, horizon) {
+				got = append(got, string(c.kind)+" "+c.event.Summary)
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("changes = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChangeMessage(t *testing.T) {
+	from := time.Date(2026, 11, 5, 0, 0, 0, 0, time.UTC)
+	oslo := pageEvent{Summary: "Trip", From: from, To: from.AddDate(0, 0, 2), AllDay: true, Location: &appleLocation{Title: "Oslo"}}
+	bergen := pageEvent{Summary: "Bergen", From: from.AddDate(0, 0, 1), To: from.AddDate(0, 0, 3), AllDay: true}
+
+	tests := []struct {
+		c    change
+		who  string
+		want string
+	}{
+		{
+			c:    change{kind: changeArrived, event: oslo},
+			who:  "Kristoffer",
+			want: "Kristoffer: Arrived: Oslo, until Saturday 07. November 2026",
+		},
+		{
+			c:    change{kind: changeAdded, event: oslo},
+			want: "New trip: Oslo, Thursday 05. November 2026 to Saturday 07. November 2026",
+		},
+		{
+			c:    change{kind: changeMoved, event: bergen, previous: &oslo},
+			want: "Trip moved: Oslo, Thursday 05. November 2026 to Saturday 07. November 2026, now Bergen, Friday 06. November 2026 to Sunday 08. November 2026",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := tt.c.message(tt.who); got != tt.want {
+			t.Errorf("message = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestParseConfigWebhooks(t *testing.T) {
+	base := config{Sources: []string{"https://example.com/a.ics"}}
+
+	cfg, err := parseConfig([]byte(`{"webhooks": [
+		{"url": "https://ntfy.sh/hvor", "format": "ntfy", "events": ["arrived"]},
+		{"url": "https://example.com/hook", "scopes": "city"},
+	]}`), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if wc := cfg.Webhooks[0]; wc.scope != fullScope || !wc.wants(changeArrived) || wc.wants(changeAdded) {
+		t.Errorf("webhooks[0] = %+v", wc)
+	}
+
+	if wc := cfg.Webhooks[1]; wc.scope.precision != precisionCity || !wc.wants(changeCancelled) {
+		t.Errorf("webhooks[1] = %+v", wc)
+	}
+
+	_, err = parseConfig([]byte(`{"webhooks": [{"url": "mailto:me@example.com", "format": "xml", "events": ["left"], "scopes": "nowhere"}]}`), base)
+
+	for _, want := range []string{
+		"webhooks[0].url: must be an http(s) URL",
+		`webhooks[0].format: unsupported format "xml"`,
+		`webhooks[0].events: unknown event "left"`,
+		"webhooks[0].scopes:",
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("err = %v, want it to contain %q", err, want)
+		}
+	}
+}
+
+// webhookRequest is a request received by a stand-in webhook receiver.
+type webhookRequest struct {
+	path, title, contentType, body string
+}
+
+// webhookReceiver starts a stand-in for webhook receivers, which refuses
+// the first failures requests to each path.
+func webhookReceiver(t *testing.T, failures int) (string, <-chan webhookRequest) {
+	t.Helper()
+
+	var (
+		mu      sync.Mutex
+		refused = make(map[string]int)
+	)
+
+	ch := make(chan webhookRequest, 100)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		refuse := refused[r.URL.Path] < failures
+		refused[r.URL.Path]++
+		mu.Unlock()
+
+		if refuse {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		ch <- webhookRequest{
+			path:        r.URL.Path,
+			title:       r.Header.Get("Title"),
+			contentType: r.Header.Get("Content-Type"),
+			body:        string(body),
+		}
+	}))
+	t.Cleanup(ts.Close)
+
+	return ts.URL, ch
+}
+
+func TestWebhooks(t *testing.T) {
+	origRetry := webhookRetry
+	webhookRetry = time.Millisecond
+	t.Cleanup(func() { webhookRetry = origRetry })
+
+	u, received := webhookReceiver(t, 2)
+
+	now := time.Now()
+	start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, 10)
+
+	h := testHvor(t, config{
+		Webhooks: []webhookConfig{
+			{URL: u + "/json", scope: fullScope},
+			{URL: u + "/ntfy", Format: "ntfy", scope: fullScope},
+			{URL: u + "/slack", Format: "slack", scope: fullScope},
+			{URL: u + "/arrivals", Events: []changeKind{changeArrived}, scope: fullScope},
+		},
+		person: person{ID: "kristoffer", Name: "Kristoffer"},
+	})
+	h.webhooks = newWebhookQueue(t.Context(), t.Logf)
+
+	set := func(summaries ...string) {
+		t.Helper()
+
+		cal := ics.NewCalendar()
+		for i, s := range summaries {
+			addLocatedEvent(cal, s, start.AddDate(0, 0, 7*i), start.AddDate(0, 0, 7*i+2), s)
+		}
+
+		if err := h.setCalendar(snapshot{calendars: []sourceCalendar{{url: "test", cal: cal}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	set("Oslo")
+	set("Oslo", "Bergen")
+
+	got := make(map[string]webhookRequest)
+
+	for range 3 {
+		select {
+		case r := <-received:
+			got[r.path] = r
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for webhooks, got %v", got)
+		}
+	}
+
+	var payload webhookPayload
+	if err := json.Unmarshal([]byte(got["/json"].body), &payload); err != nil {
+		t.Fatalf("json webhook: %s: %q", err, got["/json"].body)
+	}
+
+	if payload.Type != changeAdded || payload.Person != "kristoffer" || payload.Event.Summary != "Bergen" || payload.Event.Location == nil {
+		t.Errorf("json webhook = %+v", payload)
+	}
+
+	if r := got["/ntfy"]; r.title != "Kristoffer: New trip" || !strings.HasPrefix(r.body, "Bergen, ") || !strings.HasPrefix(r.contentType, "text/plain") {
+		t.Errorf("ntfy webhook = %+v", r)
+	}
+
+	var slack struct{ Text string }
+	if err := json.Unmarshal([]byte(got["/slack"].body), &slack); err != nil || !strings.HasPrefix(slack.Text, "Kristoffer: New trip: Bergen, ") {
+		t.Errorf("slack webhook = %q, %v", got["/slack"].body, err)
+	}
+
+	select {
+	case r := <-received:
+		t.Errorf("unexpected webhook %+v", r)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWebhookQueue(t *testing.T) {
+	origRetry := webhookRetry
+	webhookRetry = 10 * time.Millisecond
+	t.Cleanup(func() { webhookRetry = origRetry })
+
+	// The first change is retried while the others are queued behind it.
+	u, received := webhookReceiver(t, 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q := newWebhookQueue(ctx, t.Logf)
+	wc := webhookConfig{URL: u + "/ordered"}
+	oslo := pageEvent{UID: "oslo", Summary: "Oslo", From: time.Now(), To: time.Now()}
+
+	q.enqueue(wc, person{}, []change{{kind: changeAdded, event: oslo}})
+	q.enqueue(wc, person{}, []change{{kind: changeMoved, event: oslo, previous: &oslo}, {kind: changeCancelled, event: oslo}})
+
+	var got []changeKind
+
+	for range 3 {
+		select {
+		case r := <-received:
+			var payload webhookPayload
+			if err := json.Unmarshal([]byte(r.body), &payload); err != nil {
+				t.Fatal(err)
+			}
+
+			got = append(got, payload.Type)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for webhooks, got %q", got)
+		}
+	}
+
+	if want := []changeKind{changeAdded, changeMoved, changeCancelled}; !slices.Equal(got, want) {
+		t.Errorf("delivered %q, want %q", got, want)
+	}
+
+	// Nothing is delivered once the queue is shut down.
+	cancel()
+	q.enqueue(wc, person{}, []change{{kind: changeAdded, event: oslo}})
+
+	select {
+	case r := <-received:
+		t.Errorf("delivered %+v after shutdown", r)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	origRetry := webhookRetry
+	webhookRetry = time.Millisecond
+	t.Cleanup(func() { webhookRetry = origRetry })
+
+	u, received := webhookReceiver(t, webhookAttempts)
+
+	var logged []string
+	logf := func(format string, args ...any) { logged = append(logged, fmt.Sprintf(format, args...)) }
+
+	wc := webhookConfig{URL: u + "/down"}
+	c := change{kind: changeCancelled, event: pageEvent{Summary: "Oslo", From: time.Now(), To: time.Now()}}
+
+	wc.deliver(context.Background(), person{}, c, logf)
+
+	if len(logged) != 1 || !strings.Contains(logged[0], "giving up") {
+		t.Errorf("logged %q, want the delivery given up on", logged)
+	}
+
+	select {
+	case r := <-received:
+		t.Errorf("received %+v, want every attempt refused", r)
+	default:
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	fetchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "hvor_calendar_fetch_duration_seconds",
+		Help:    "Time taken to fetch a calendar source.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"person", "source"})
+
+	fetchesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hvor_calendar_fetches_total",
+		Help: "Calendar fetches by source and result: ok, not_modified, http_<status>, parse_error or error.",
+	}, []string{"person", "source", "result"})
+
+	lastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "hvor_calendar_last_success_timestamp_seconds",
+		Help: "When a calendar source was last fetched successfully.",
+	}, []string{"person", "source"})
+
+	lastUpdate = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "hvor_calendar_last_update_timestamp_seconds",
+		Help: "When the page was last updated from the calendars.",
+	}, []string{"person"})
+
+	pageEventsCount = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "hvor_page_events",
+		Help: "Events on the page by window: past, current or future.",
+	}, []string{"person", "window"})
+
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hvor_http_requests_total",
+		Help: "HTTP requests by handler, method and status code.",
+	}, []string{"handler", "method", "code"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "hvor_http_request_duration_seconds",
+		Help:    "Time taken to serve HTTP requests by handler.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"handler", "method"})
+
+	webhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hvor_webhook_deliveries_total",
+		Help: "Changes delivered to webhooks by format and result: ok or failed.",
+	}, []string{"format", "result"})
+)
+
+// statusError is an unexpected HTTP status from a calendar server.
+type statusError struct {
+	op   string
+	code int
+}
+
+func (e statusError) Error() string {
+	return e.op + " returned status " + strconv.Itoa(e.code)
+}
+
+// parseError is a calendar that could not be parsed.
+type parseError struct {
+	err error
+}
+
+func (e parseError) Error() string {
+	return "failed to parse calendar: " + e.err.Error()
+}
+
+func (e parseError) Unwrap() error {
+	return e.err
+}
+
+// fetchResult classifies the outcome of a fetch for fetchesTotal.
+func fetchResult(err error) string {
+	var se statusError
+
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, errNotModified):
+		return "not_modified"
+	case errors.As(err, &se):
+		return "http_" + strconv.Itoa(se.code)
+	case errors.As(err, new(parseError)):
+		return "parse_error"
+	}
+
+	return "error"
+}
+
+// sourceLabel names the source at index i of the config in metrics. The
+// index tells apart the calendars of one host, which is all that is left
+// of the URL once redacted.
+func sourceLabel(i int, src string) string {
+	return strconv.Itoa(i) + " " + redactSource(src)
+}
+
+// observeFetch records a fetch of the source labelled source, of person,
+// that started at start.
+func observeFetch(person, source string, start time.Time, err error) {
+	fetchDuration.WithLabelValues(person, source).Observe(time.Since(start).Seconds())
+	fetchesTotal.WithLabelValues(person, source, fetchResult(err)).Inc()
+
+	if err == nil || errors.Is(err, errNotModified) {
+		lastSuccess.WithLabelValues(person, source).Set(float64(time.Now().Unix()))
+	}
+}
+
+// observePage records the size of a freshly built page of person.
+func observePage(person string, p *page) {
+	current := len(p.Concurrent)
+	if p.Current != nil {
+		current++
+	}
+
+	pageEventsCount.WithLabelValues(person, "past").Set(float64(len(p.Past)))
+	pageEventsCount.WithLabelValues(person, "current").Set(float64(current))
+	pageEventsCount.WithLabelValues(person, "future").Set(float64(len(p.Future)))
+}
+
+// instrument counts and times the requests served by handler under name.
+func instrument(name string, handler http.Handler) http.Handler {
+	labels := prometheus.Labels{"handler": name}
+
+	return promhttp.InstrumentHandlerCounter(
+		requestsTotal.MustCurryWith(labels),
+		promhttp.InstrumentHandlerDuration(requestDuration.MustCurryWith(labels), handler),
+	)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// overviewPerson is where someone of the team is, for the overview.
+type overviewPerson struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Current   *apiEvent `json:"current"`
+	Next      *apiEvent `json:"next"`
+	LocalTime time.Time `json:"localTime,omitzero"`
+	TimeZone  string    `json:"timeZone,omitempty"`
+	LastFetch time.Time `json:"lastFetch,omitzero"`
+	Stale     bool      `json:"stale"`
+}
+
+// overview is the whole team as served by the JSON API.
+type overview struct {
+	People      []overviewPerson `json:"people"`
+	Colocations []colocation     `json:"colocations"`
+}
+
+// newOverviewPerson returns where the person of h is at now, as seen by v.
+func newOverviewPerson(h *hvor, v viewer, now time.Time) overviewPerson {
+	who := h.config().person
+	ret := overviewPerson{ID: who.ID, Name: who.Name}
+
+	s := h.snap.Load()
+	if s == nil {
+		return ret
+	}
+
+	p := s.calPage.restrict(v.scope)
+	fresh := s.freshness()
+
+	ret.LastFetch = fresh.lastFetch
+	ret.Stale = fresh.stale
+
+	if p.Current != nil {
+		cur := newAPIEvent(*p.Current)
+		ret.Current = &cur
+	}
+
+	if next := nextTrip(p); next != nil {
+		ev := newAPIEvent(*next)
+		ret.Next = &ev
+	}
+
+	if loc := localZone(p); loc != nil {
+		ret.LocalTime = now.In(loc)
+		ret.TimeZone = loc.String()
+	}
+
+	return ret
+}
+
+// nextTrip returns the next event somewhere, or else just the next event.
+func nextTrip(p *page) *pageEvent {
+	for i := range p.Future {
+		if p.Future[i].Location != nil {
+			return &p.Future[i]
+		}
+	}
+
+	if len(p.Future) > 0 {
+		return &p.Future[0]
+	}
+
+	return nil
+}
+
+// localZone guesses the time zone someone is in: the zone of a timed event
+// they are at, or else one approximated from the longitude of where they
+// are.
+func localZone(p *page) *time.Location {
+	var now pageEvents
+	if p.Current != nil {
+		now = append(now, *p.Current)
+	}
+
+	now = append(now, p.Concurrent...)
+
+	for _, pe := range now {
+		if loc := pe.From.Location(); !pe.AllDay && loc != time.UTC && loc != time.Local {
+			return loc
+		}
+	}
+
+	if p.Current == nil || p.Current.Location == nil {
+		return nil
+	}
+
+	lon := parseCoordinate(p.Current.Location.Longitude)
+	if lon == nil {
+		return nil
+	}
+
+	offset := int(math.Round(*lon / 15))
+
+	return time.FixedZone(fmt.Sprintf("UTC%+d", offset), offset*60*60)
+}
+
+// overview returns where everyone in the team is at now, and when they
+// are close to each other, as seen by v.
+func (t *team) overview(v viewer, now time.Time) overview {
+	members := t.people()
+
+	ret := overview{
+		People:      make([]overviewPerson, 0, len(members)),
+		Colocations: colocations(members, t.hvor.config().Colocation, v),
+	}
+
+	for _, h := range members {
+		ret.People = append(ret.People, newOverviewPerson(h, v, now))
+	}
+
+	return ret
+}
+
+// overviewHandler shows where everyone in the team is, on one map.
+func (t *team) overviewHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v, ok := t.hvor.authorise(w, r, accessPage)
+		if !ok {
+			return
+		}
+
+		o := t.overview(v, time.Now())
+
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(overviewPage(o, v.scope.precision, t.hvor.config().Map.Token).Render()))
+	})
+}
+
+// overviewAPIHandler serves the overview as JSON.
+func (t *team) overviewAPIHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v, ok := t.hvor.authorise(w, r, accessToken)
+		if !ok {
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(t.overview(v, time.Now()))
+	})
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"slices"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+// maxRecurrencePeriods bounds how many FREQ periods a single rule is
+// walked through, so an open ended rule starting decades ago cannot keep
+// the updater busy.
+const maxRecurrencePeriods = 50000
+
+var icsWeekdays = map[ics.Weekday]time.Weekday{
+	ics.WeekdaySunday:    time.Sunday,
+	ics.WeekdayMonday:    time.Monday,
+	ics.WeekdayTuesday:   time.Tuesday,
+	ics.WeekdayWednesday: time.Wednesday,
+	ics.WeekdayThursday:  time.Thursday,
+	ics.WeekdayFriday:    time.Friday,
+	ics.WeekdaySaturday:  time.Saturday,
+}
+
+// recurrence holds the recurrence properties of a VEVENT.
+type recurrence struct {
+	rrules  []*ics.RecurrenceRule
+	exrules []*ics.RecurrenceRule
+	rdates  []time.Time
+	exdates []time.Time
+	allDay  bool
+}
+
+// getRecurrence reads RRULE, EXRULE, RDATE and EXDATE from the event.
+// It returns nil if the event does not recur.
+func getRecurrence(event *ics.VEvent, tzs timezones, allDay bool) (*recurrence, error) {
+	rrules, err := event.GetRRules()
+	if err != nil {
+		return nil, err
+	}
+
+	rdates, err := dateList(event, ics.ComponentPropertyRdate, tzs)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rrules) == 0 && len(rdates) == 0 {
+		return nil, nil
+	}
+
+	exrules, err := event.GetExRules()
+	if err != nil {
+		return nil, err
+	}
+
+	exdates, err := dateList(event, ics.ComponentPropertyExdate, tzs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &recurrence{
+		rrules:  rrules,
+		exrules: exrules,
+		rdates:  rdates,
+		exdates: exdates,
+		allDay:  allDay,
+	}, nil
+}
+
+func dateList(event *ics.VEvent, prop ics.ComponentProperty, tzs timezones) ([]time.Time, error) {
+	var ret []time.Time
+
+	for _, p := range event.GetProperties(prop) {
+		ts, err := tzs.parseProperty(p)
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, ts...)
+	}
+
+	return ret, nil
+}
+
+// occurrenceKey identifies an instance of a recurring event, and is used to
+// match EXDATE and RECURRENCE-ID values against expanded start times.
+// All-day instances are compared by date only, as calendars are
+// inconsistent about whether those values carry a time.
+func occurrenceKey(t time.Time, allDay bool) string {
+	if allDay {
+		return t.Format(icalDateFormat)
+	}
+
+	return t.UTC().Format(icalDateTimeFormat + "Z")
+}
+
+// occurrences returns the sorted start times of every instance of the
+// event starting at dtstart, up to but not including windowEnd.
+func (r *recurrence) occurrences(dtstart, windowEnd time.Time) []time.Time {
+	starts := make(map[string]time.Time)
+
+	add := func(ts []time.Time) {
+		for _, t := range ts {
+			if t.Before(windowEnd) {
+				starts[occurrenceKey(t, r.allDay)] = t
+			}
+		}
+	}
+
+	add([]time.Time{dtstart})
+	add(r.rdates)
+
+	for _, rule := range r.rrules {
+		add(expandRule(rule, dtstart, windowEnd))
+	}
+
+	for _, rule := range r.exrules {
+		for _, t := range expandRule(rule, dtstart, windowEnd) {
+			delete(starts, occurrenceKey(t, r.allDay))
+		}
+	}
+
+	for _, t := range r.exdates {
+		delete(starts, occurrenceKey(t, r.allDay))
+	}
+
+	ret := make([]time.Time, 0, len(starts))
+	for _, t := range starts {
+		ret = append(ret, t)
+	}
+
+	slices.SortFunc(ret, func(a, b time.Time) int {
+		return a.Compare(b)
+	})
+
+	return ret
+}
+
+// expandRule returns the start times generated by a single RRULE, in
+// order, that start before windowEnd. COUNT is honoured from dtstart, so
+// instances before any display window still count towards it, and
+// dtstart counts as the first instance even if the rule does not
+// generate it, as RFC 5545 has it.
+//
+// Instances keep the time of day of dtstart; BYHOUR, BYMINUTE, BYSECOND
+// and BYWEEKNO are not supported, as they make little sense for
+// whereabouts.
+func expandRule(rule *ics.RecurrenceRule, dtstart, windowEnd time.Time) []time.Time {
+	var ret []time.Time
+
+	interval := max(rule.Interval, 1)
+	count := 0
+
+	if _, first := periodCandidates(rule, dtstart, 0); !slices.ContainsFunc(first, dtstart.Equal) {
+		count++
+	}
+
+	for n := range maxRecurrencePeriods {
+		periodStart, candidates := periodCandidates(rule, dtstart, n*interval)
+		if !periodStart.Before(windowEnd) {
+			break
+		}
+
+		for _, c := range candidates {
+			if c.Before(dtstart) {
+				continue
+			}
+
+			if afterUntil(rule, c) {
+				return ret
+			}
+
+			if rule.Count > 0 && count >= rule.Count {
+				return ret
+			}
+
+			count++
+
+			if !c.Before(windowEnd) {
+				return ret
+			}
+
+			ret = append(ret, c)
+		}
+	}
+
+	return ret
+}
+
+func afterUntil(rule *ics.RecurrenceRule, t time.Time) bool {
+	if rule.Until.IsZero() {
+		return false
+	}
+
+	if rule.UntilDateOnly {
+		y, m, d := rule.Until.Date()
+
+		return t.After(time.Date(y, m, d, 23, 59, 59, 0, t.Location()))
+	}
+
+	return t.After(rule.Until)
+}
+
+// periodCandidates returns the start of the n-th FREQ period after
+// dtstart, and the sorted instances the rule generates inside it.
+func periodCandidates(rule *ics.RecurrenceRule, dtstart time.Time, n int) (time.Time, []time.Time) {
+	year, month, day := dtstart.Date()
+
+	at := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, dtstart.Hour(), dtstart.Minute(), dtstart.Second(), 0, dtstart.Location())
+	}
+
+	var periodStart time.Time
+	var candidates []time.Time
+
+	switch rule.Freq {
+	case ics.FrequencyDaily:
+		periodStart = at(year, month, day+n)
+		if matchesDay(rule, periodStart) {
+			candidates = []time.Time{periodStart}
+		}
+
+	case ics.FrequencyWeekly:
+		wkst := time.Monday
+		if wd, ok := icsWeekdays[rule.Wkst]; ok {
+			wkst = wd
+		}
+
+		offset := (int(dtstart.Weekday()) - int(wkst) + 7) % 7
+		periodStart = at(year, month, day-offset+7*n)
+
+		if len(rule.ByDay) == 0 {
+			candidates = []time.Time{at(year, month, day+7*n)}
+		} else {
+			for i := range 7 {
+				d := periodStart.AddDate(0, 0, i)
+				if hasWeekday(rule.ByDay, d.Weekday()) {
+					candidates = append(candidates, d)
+				}
+			}
+		}
+
+		candidates = slices.DeleteFunc(candidates, func(t time.Time) bool {
+			return len(rule.ByMonth) > 0 && !slices.Contains(rule.ByMonth, int(t.Month()))
+		})
+
+	case ics.FrequencyMonthly:
+		periodStart = at(year, month+time.Month(n), 1)
+		if len(rule.ByMonth) == 0 || slices.Contains(rule.ByMonth, int(periodStart.Month())) {
+			candidates = monthInstances(rule, periodStart, day)
+		}
+
+	case ics.FrequencyYearly:
+		periodStart = at(year+n, time.January, 1)
+
+		switch {
+		case len(rule.ByMonth) > 0:
+			for _, m := range rule.ByMonth {
+				candidates = append(candidates, monthInstances(rule, at(year+n, time.Month(m), 1), day)...)
+			}
+		case len(rule.ByYearDay) > 0:
+			days := daysIn(periodStart, periodStart.AddDate(1, 0, 0))
+			for _, yd := range rule.ByYearDay {
+				if i := resolveOrdinal(yd, len(days)); i >= 0 {
+					candidates = append(candidates, days[i])
+				}
+			}
+		case len(rule.ByDay) > 0 && len(rule.ByMonthDay) == 0:
+			candidates = weekdayInstances(rule.ByDay, periodStart, periodStart.AddDate(1, 0, 0))
+		default:
+			candidates = monthInstances(rule, at(year+n, month, 1), day)
+		}
+
+	default:
+		// Sub-daily frequencies are not meaningful for whereabouts.
+		return dtstart.AddDate(1000, 0, 0), nil
+	}
+
+	slices.SortFunc(candidates, func(a, b time.Time) int {
+		return a.Compare(b)
+	})
+	candidates = slices.CompactFunc(candidates, func(a, b time.Time) bool {
+		return a.Equal(b)
+	})
+
+	return periodStart, applySetPos(rule.BySetPos, candidates)
+}
+
+// monthInstances returns the instances generated within the month
+// starting at first, falling back to the day of month of DTSTART when the
+// rule has neither BYMONTHDAY nor BYDAY. Days that do not exist in the
+// month, like the 31st of April, are skipped.
+func monthInstances(rule *ics.RecurrenceRule, first time.Time, day int) []time.Time {
+	next := first.AddDate(0, 1, 0)
+	days := daysIn(first, next)
+
+	var byMonthDay []time.Time
+	for _, md := range rule.ByMonthDay {
+		if i := resolveOrdinal(md, len(days)); i >= 0 {
+			byMonthDay = append(byMonthDay, days[i])
+		}
+	}
+
+	switch {
+	case len(rule.ByMonthDay) > 0 && len(rule.ByDay) > 0:
+		return slices.DeleteFunc(byMonthDay, func(t time.Time) bool {
+			return !slices.ContainsFunc(weekdayInstances(rule.ByDay, first, next), t.Equal)
+		})
+	case len(rule.ByMonthDay) > 0:
+		return byMonthDay
+	case len(rule.ByDay) > 0:
+		return weekdayInstances(rule.ByDay, first, next)
+	case day <= len(days):
+		return []time.Time{days[day-1]}
+	}
+
+	return nil
+}
+
+// weekdayInstances returns the days in [from, to) matching any of the
+// given weekdays. An ordinal selects a single occurrence of the weekday
+// within the range, counting from the end when negative.
+func weekdayInstances(byDay []ics.WeekdayNum, from, to time.Time) []time.Time {
+	var ret []time.Time
+
+	days := daysIn(from, to)
+
+	for _, wdn := range byDay {
+		wd, ok := icsWeekdays[wdn.Day]
+		if !ok {
+			continue
+		}
+
+		matching := slices.DeleteFunc(slices.Clone(days), func(t time.Time) bool {
+			return t.Weekday() != wd
+		})
+
+		if wdn.OrdWeek == 0 {
+			ret = append(ret, matching...)
+
+			continue
+		}
+
+		if i := resolveOrdinal(wdn.OrdWeek, len(matching)); i >= 0 {
+			ret = append(ret, matching[i])
+		}
+	}
+
+	return ret
+}
+
+// daysIn returns every day in [from, to), keeping the time of day of from.
+func daysIn(from, to time.Time) []time.Time {
+	var ret []time.Time
+
+	for d := from; d.Before(to); d = d.AddDate(0, 0, 1) {
+		ret = append(ret, d)
+	}
+
+	return ret
+}
+
+// resolveOrdinal turns a 1-based, possibly negative, iCal ordinal into a
+// slice index, returning -1 if it is out of range.
+func resolveOrdinal(ord, length int) int {
+	switch {
+	case ord > 0 && ord <= length:
+		return ord - 1
+	case ord < 0 && -ord <= length:
+		return length + ord
+	}
+
+	return -1
+}
+
+func matchesDay(rule *ics.RecurrenceRule, t time.Time) bool {
+	if len(rule.ByMonth) > 0 && !slices.Contains(rule.ByMonth, int(t.Month())) {
+		return false
+	}
+
+	if len(rule.ByMonthDay) > 0 {
+		last := time.Date(t.Year(), t.Month()+1, 0, 0, 0, 0, 0, t.Location()).Day()
+		if !slices.ContainsFunc(rule.ByMonthDay, func(md int) bool {
+			return resolveOrdinal(md, last) == t.Day()-1
+		}) {
+			return false
+		}
+	}
+
+	if len(rule.ByDay) > 0 && !hasWeekday(rule.ByDay, t.Weekday()) {
+		return false
+	}
+
+	return true
+}
+
+func hasWeekday(byDay []ics.WeekdayNum, wd time.Weekday) bool {
+	return slices.ContainsFunc(byDay, func(wdn ics.WeekdayNum) bool {
+		return icsWeekdays[wdn.Day] == wd
+	})
+}
+
+func applySetPos(setPos []int, candidates []time.Time) []time.Time {
+	if len(setPos) == 0 {
+		return candidates
+	}
+
+	var ret []time.Time
+
+	for _, pos := range setPos {
+		if i := resolveOrdinal(pos, len(candidates)); i >= 0 {
+			ret = append(ret, candidates[i])
+		}
+	}
+
+	slices.SortFunc(ret, func(a, b time.Time) int {
+		return a.Compare(b)
+	})
+
+	return ret
+}
+
+// recurrenceOverrides collects the events carrying a RECURRENCE-ID, which
+// replace a single instance of a recurring event, keyed by UID and then
+// by occurrenceKey of the instance they replace.
+func recurrenceOverrides(events []*ics.VEvent, tzs timezones) map[string]map[string]*ics.VEvent {
+	ret := make(map[string]map[string]*ics.VEvent)
+
+	for _, event := range events {
+		prop := event.GetProperty(ics.ComponentPropertyRecurrenceId)
+		if prop == nil {
+			continue
+		}
+
+		rid, allDay, err := tzs.parse(prop.Value, prop.ICalParameters)
+		if err != nil {
+			continue
+		}
+
+		uid := event.Id()
+		if ret[uid] == nil {
+			ret[uid] = make(map[string]*ics.VEvent)
+		}
+
+		ret[uid][occurrenceKey(rid, allDay)] = event
+	}
+
+	return ret
+}
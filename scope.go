@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// precision is how exactly a viewer may see where we are.
+type precision int
+
+const (
+	precisionExact precision = iota
+	precisionCity
+	precisionCountry
+)
+
+// scope is what a viewer is allowed to see.
+type scope struct {
+	precision    precision
+	descriptions bool
+}
+
+// redactedSummary replaces the summary of events without a place for
+// viewers that may not see exact whereabouts.
+const redactedSummary = "Away"
+
+// fullScope is the scope of Tailscale users and of tokens given without
+// scopes.
+var fullScope = scope{precision: precisionExact, descriptions: true}
+
+// parseScope parses a "+" separated list of scopes: one of "exact",
+// "city" or "country", and "descriptions" to show event descriptions. The
+// precision defaults to exact.
+func parseScope(str string) (scope, error) {
+	var sc scope
+
+	for _, name := range strings.Split(str, "+") {
+		switch strings.TrimSpace(name) {
+		case "exact":
+			sc.precision = precisionExact
+		case "city":
+			sc.precision = precisionCity
+		case "country":
+			sc.precision = precisionCountry
+		case "descriptions":
+			sc.descriptions = true
+		default:
+			return scope{}, fmt.Errorf("unknown scope %q", name)
+		}
+	}
+
+	return sc, nil
+}
+
+// maxZoom is the closest the map may zoom in at this precision, zero
+// meaning no limit.
+func (p precision) maxZoom() int {
+	switch p {
+	case precisionCity:
+		return 10
+	case precisionCountry:
+		return 4
+	}
+
+	return 0
+}
+
+// restrict returns the page as seen with the given scope.
+func (p *page) restrict(sc scope) *page {
+	if sc == fullScope {
+		return p
+	}
+
+	ret := page{
+		Concurrent: restrictEvents(p.Concurrent, sc),
+		Past:       restrictEvents(p.Past, sc),
+		Future:     restrictEvents(p.Future, sc),
+		Precision:  sc.precision,
+	}
+
+	if p.Current != nil {
+		cur := p.Current.restrict(sc)
+		ret.Current = &cur
+	}
+
+	return &ret
+}
+
+func restrictEvents(es pageEvents, sc scope) pageEvents {
+	ret := make(pageEvents, 0, len(es))
+	for _, pe := range es {
+		ret = append(ret, pe.restrict(sc))
+	}
+
+	return ret
+}
+
+func (pe pageEvent) restrict(sc scope) pageEvent {
+	if !sc.descriptions {
+		pe.Description = []string{}
+	}
+
+	if pe.Location != nil {
+		loc := pe.Location.coarsen(sc.precision)
+		pe.Location = &loc
+	}
+
+	// Summaries like "Dinner at <address>" tell more than the precision
+	// allows, so they are replaced by the coarsened place.
+	if sc.precision != precisionExact {
+		pe.Summary = redactedSummary
+		if pe.Location != nil && pe.Location.Title != "" {
+			pe.Summary = pe.Location.Title
+		}
+	}
+
+	return pe
+}
+
+// coarsen returns the location as precise as p allows: at city precision
+// the title keeps its last two parts, typically city and country, and the
+// coordinates are rounded to about 10 km; at country precision only the
+// last part is kept and the coordinates are rounded to about 100 km. The
+// radius grows to cover the rounding.
+func (loc appleLocation) coarsen(p precision) appleLocation {
+	var parts, decimals int
+	var radius float64
+
+	switch p {
+	case precisionCity:
+		parts, decimals, radius = 2, 1, 10_000
+	case precisionCountry:
+		parts, decimals, radius = 1, 0, 150_000
+	default:
+		return loc
+	}
+
+	titleParts := strings.Split(loc.Title, ", ")
+	if len(titleParts) > parts {
+		titleParts = titleParts[len(titleParts)-parts:]
+	}
+
+	return appleLocation{
+		Title:     strings.Join(titleParts, ", "),
+		Radius:    max(loc.Radius, radius),
+		Latitude:  roundCoordinate(loc.Latitude, decimals),
+		Longitude: roundCoordinate(loc.Longitude, decimals),
+	}
+}
+
+func roundCoordinate(str string, decimals int) string {
+	f, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return ""
+	}
+
+	scale := math.Pow(10, float64(decimals))
+
+	return strconv.FormatFloat(math.Round(f*scale)/scale, 'f', decimals, 64)
+}
+
+// viewer is who is looking at hvor, and what they may see. The label names
+// them in the audit log and metrics.
+type viewer struct {
+	scope scope
+	label string
+
+	// expires is when the link or session of the viewer stops working,
+	// zero if it does not.
+	expires time.Time
+}
+
+// until returns v expiring at t at the latest, for a zero t meaning never.
+func (v viewer) until(t time.Time) viewer {
+	if !t.IsZero() && (v.expires.IsZero() || t.Before(v.expires)) {
+		v.expires = t
+	}
+
+	return v
+}
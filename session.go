@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const sessionCookie = "hvor_session"
+
+// session is the content of the session cookie. It holds the from token it
+// was exchanged for, so the token is checked again on every request and a
+// revoked or expired link ends the session.
+type session struct {
+	Token   string `json:"t"`
+	Expires int64  `json:"e"`
+}
+
+// sessionSigningKey returns the key session cookies are signed with:
+// derived from the share key if there is one, so sessions survive
+// restarts, and random otherwise.
+func (h *hvor) sessionSigningKey() []byte {
+	h.sessionOnce.Do(func() {
+		if h.shareKey != nil {
+			mac := hmac.New(sha256.New, h.shareKey)
+			_, _ = mac.Write([]byte("hvor session"))
+			h.sessionKey = mac.Sum(nil)
+
+			return
+		}
+
+		h.sessionKey = make([]byte, sha256.Size)
+		_, _ = rand.Read(h.sessionKey)
+	})
+
+	return h.sessionKey
+}
+
+// sessionCookieFor returns a session cookie for the from token. In a team,
+// it is limited to the pages of the person it was started for.
+func (h *hvor) sessionCookieFor(r *http.Request, token string, now time.Time) *http.Cookie {
+	expires := now.Add(*sessionDuration)
+
+	data, _ := json.Marshal(session{Token: token, Expires: expires.Unix()})
+	payload := base64.RawURLEncoding.EncodeToString(data)
+
+	return &http.Cookie{
+		Name:     sessionCookie,
+		Value:    payload + "." + signShareLink(h.sessionSigningKey(), payload),
+		Path:     h.config().person.base() + "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// sessionToken returns the from token of the session of r, and when the
+// session expires, if it has a valid one.
+func (h *hvor) sessionToken(r *http.Request, now time.Time) (string, time.Time, bool) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+
+	payload, sig, ok := strings.Cut(c.Value, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(signShareLink(h.sessionSigningKey(), payload))) {
+		return "", time.Time{}, false
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+
+	var s session
+	if err := json.Unmarshal(data, &s); err != nil {
+		return "", time.Time{}, false
+	}
+
+	expires := time.Unix(s.Expires, 0)
+	if !now.Before(expires) {
+		return "", time.Time{}, false
+	}
+
+	return s.Token, expires, true
+}
+
+// withoutFrom returns the URL of r without its from token.
+func withoutFrom(r *http.Request) string {
+	u := *r.URL
+
+	q := u.Query()
+	q.Del("from")
+	u.RawQuery = q.Encode()
+
+	return u.RequestURI()
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const minShareKeyLength = 32
+
+var (
+	errBadShareLink     = errors.New("invalid share link")
+	errExpiredShareLink = errors.New("share link has expired")
+)
+
+// shareLink is what a signed share link grants. It is carried in the from
+// parameter as base64url(JSON) "." base64url(HMAC-SHA256), so hvor can
+// verify it without keeping any state.
+type shareLink struct {
+	Label   string `json:"l"`
+	Scopes  string `json:"s,omitempty"`
+	Person  string `json:"p,omitempty"`
+	Expires int64  `json:"e"`
+
+	scope scope
+}
+
+// loadShareKey reads the key share links are signed with.
+func loadShareKey(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read share key: %w", err)
+	}
+
+	key := []byte(strings.TrimSpace(string(content)))
+	if len(key) < minShareKeyLength {
+		return nil, fmt.Errorf("share key must be at least %d bytes", minShareKeyLength)
+	}
+
+	return key, nil
+}
+
+func signShareLink(key []byte, payload string) string {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(payload))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// mintShareLink returns the from token of a link granting scopes, named
+// label, until expires. In a team, a link with a person only opens their
+// pages.
+func mintShareLink(key []byte, label, scopes, person string, expires time.Time) (string, error) {
+	if scopes != "" {
+		if _, err := parseScope(scopes); err != nil {
+			return "", err
+		}
+	}
+
+	if person != "" && !rePersonID.MatchString(person) {
+		return "", fmt.Errorf("invalid person %q", person)
+	}
+
+	data, err := json.Marshal(shareLink{Label: label, Scopes: scopes, Person: person, Expires: expires.Unix()})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode share link: %w", err)
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(data)
+
+	return payload + "." + signShareLink(key, payload), nil
+}
+
+// verifyShareLink checks the signature and expiry of a share link.
+func verifyShareLink(key []byte, token string, now time.Time) (shareLink, error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return shareLink{}, errBadShareLink
+	}
+
+	if !hmac.Equal([]byte(sig), []byte(signShareLink(key, payload))) {
+		return shareLink{}, errBadShareLink
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return shareLink{}, errBadShareLink
+	}
+
+	var link shareLink
+	if err := json.Unmarshal(data, &link); err != nil {
+		return shareLink{}, errBadShareLink
+	}
+
+	if !now.Before(time.Unix(link.Expires, 0)) {
+		return shareLink{}, errExpiredShareLink
+	}
+
+	link.scope = fullScope
+
+	if link.Scopes != "" {
+		sc, err := parseScope(link.Scopes)
+		if err != nil {
+			return shareLink{}, errBadShareLink
+		}
+
+		link.scope = sc
+	}
+
+	return link, nil
+}
+
+// mintLinkCommand implements "hvor mint-link", printing a new share link.
+func mintLinkCommand(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("mint-link", flag.ContinueOnError)
+
+	keyPath := fs.String("share-key-path", *shareKeyPath, "Path to the key share links are signed with")
+	label := fs.String("label", "", "Who the link is for, shown in logs and metrics")
+	scopes := fs.String("scopes", "", "Scopes of the link, e.g. city+descriptions, everything if empty")
+	who := fs.String("person", "", "In a team, the id of the person whose pages the link opens, everyone's if empty")
+	valid := fs.Duration("valid", 7*24*time.Hour, "How long the link is valid")
+	baseURL := fs.String("base-url", "", "URL of hvor to print the full link for")
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+
+		return err
+	}
+
+	if *keyPath == "" {
+		return fmt.Errorf("a share key is required, see -share-key-path")
+	}
+
+	if *label == "" {
+		return fmt.Errorf("a label is required")
+	}
+
+	if *valid <= 0 {
+		return fmt.Errorf("links must be valid for a positive duration")
+	}
+
+	key, err := loadShareKey(*keyPath)
+	if err != nil {
+		return err
+	}
+
+	expires := time.Now().Add(*valid)
+
+	token, err := mintShareLink(key, *label, *scopes, *who, expires)
+	if err != nil {
+		return err
+	}
+
+	link := token
+
+	if *baseURL != "" {
+		u, err := url.Parse(*baseURL)
+		if err != nil {
+			return fmt.Errorf("invalid base url: %w", err)
+		}
+
+		q := u.Query()
+		q.Set("from", token)
+		u.RawQuery = q.Encode()
+		link = u.String()
+	}
+
+	_, _ = fmt.Fprintf(out, "%s\n(valid until %s)\n", link, expires.Format(time.RFC3339))
+
+	return nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+// parseSources splits a comma separated list of calendar sources.
+func parseSources(str string) []string {
+	var ret []string
+
+	for _, src := range strings.Split(str, ",") {
+		if src = strings.TrimSpace(src); src != "" {
+			ret = append(ret, src)
+		}
+	}
+
+	return ret
+}
+
+// fetchSource fetches the raw iCal data of a calendar source. http(s)
+// URLs are fetched conditionally, webcal:// URLs are fetched over https,
+// caldav:// and caldavs:// URLs are queried over CalDAV using http and
+// https respectively, with the credentials at the path credentials, and
+// file:// URLs and plain paths are read from disk.
+func fetchSource(src string, v validators, w window, credentials string) ([]byte, validators, error) {
+	u, err := url.Parse(src)
+	if err != nil || u.Scheme == "" {
+		return readSourceFile(src, v)
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		return fetchCalendarBody(src, v)
+	case "webcal", "webcals":
+		u.Scheme = "https"
+
+		return fetchCalendarBody(u.String(), v)
+	case "caldav":
+		u.Scheme = "http"
+
+		return fetchCalDAV(u, v, w, credentials)
+	case "caldavs":
+		u.Scheme = "https"
+
+		return fetchCalDAV(u, v, w, credentials)
+	case "file":
+		return readSourceFile(u.Path, v)
+	}
+
+	return nil, v, fmt.Errorf("unsupported calendar source scheme %q", u.Scheme)
+}
+
+func readSourceFile(path string, v validators) ([]byte, validators, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, v, fmt.Errorf("failed to read calendar file: %w", err)
+	}
+
+	return body, v, nil
+}
+
+// redactSource returns a name for a source that is safe to log and show.
+// Shared calendar URLs carry their secret in the path, so only the scheme
+// and host are kept.
+func redactSource(src string) string {
+	u, err := url.Parse(src)
+	if err != nil || u.Scheme == "" || u.Scheme == "file" {
+		return src
+	}
+
+	if u.Path == "" && u.RawQuery == "" {
+		return u.Scheme + "://" + u.Host
+	}
+
+	return u.Scheme + "://" + u.Host + "/…"
+}
+
+// redactError removes the secret parts of src from an error message, as
+// errors from the HTTP client carry the full URL.
+func redactError(msg, src string) string {
+	msg = strings.ReplaceAll(msg, src, redactSource(src))
+
+	u, err := url.Parse(src)
+	if err != nil || u.Scheme == "" || u.Scheme == "file" {
+		return msg
+	}
+
+	// The URL may have been fetched with another scheme, like webcal://
+	// over https.
+	if secret := strings.TrimPrefix(u.RequestURI(), "/"); secret != "" {
+		msg = strings.ReplaceAll(msg, secret, "…")
+	}
+
+	return msg
+}
+
+// sourceCalendar is the last known state of a single calendar source.
+// When a fetch fails, the data of the last successful fetch is kept so
+// one failing source does not wipe the others.
+type sourceCalendar struct {
+	url        string
+	raw        []byte
+	cal        *ics.Calendar
+	validators validators
+	lastFetch  time.Time
+	err        error
+}
+
+// fetch returns the source updated from upstream, reading CalDAV
+// calendars for the events within w with the credentials at the path
+// credentials. Fetches are recorded in metrics for person under label.
+func (sc sourceCalendar) fetch(now time.Time, w window, credentials, person, label string) sourceCalendar {
+	start := time.Now()
+
+	body, v, err := fetchSource(sc.url, sc.validators, w, credentials)
+	if err != nil {
+		observeFetch(person, label, start, err)
+	}
+
+	switch {
+	case errors.Is(err, errNotModified) && sc.cal != nil:
+		sc.lastFetch = now
+		sc.validators = v
+		sc.err = nil
+
+		return sc
+	case err != nil:
+		sc.err = err
+
+		return sc
+	}
+
+	cal, err := parseCalendar(body)
+	observeFetch(person, label, start, err)
+
+	if err != nil {
+		sc.err = err
+
+		return sc
+	}
+
+	sc.raw = body
+	sc.cal = cal
+	sc.validators = v
+	sc.lastFetch = now
+	sc.err = nil
+
+	return sc
+}
+
+// sourceHealth is the state of a calendar source as reported to operators.
+type sourceHealth struct {
+	Source    string    `json:"source"`
+	LastFetch time.Time `json:"lastFetch,omitzero"`
+	Error     string    `json:"error,omitempty"`
+}
+
+func (sc sourceCalendar) health() sourceHealth {
+	ret := sourceHealth{
+		Source:    redactSource(sc.url),
+		LastFetch: sc.lastFetch,
+	}
+
+	if sc.err != nil {
+		ret.Error = redactError(sc.err.Error(), sc.url)
+	}
+
+	return ret
+}
+
+// calendarsHash fingerprints the data of all sources, in order.
+func calendarsHash(cals []sourceCalendar) [sha256.Size]byte {
+	h := sha256.New()
+
+	for _, sc := range cals {
+		_ = binary.Write(h, binary.BigEndian, int64(len(sc.raw)))
+		_, _ = h.Write(sc.raw)
+	}
+
+	var ret [sha256.Size]byte
+	copy(ret[:], h.Sum(nil))
+
+	return ret
+}
+
+// mergeCalendars combines the events and time zones of several calendars
+// into one. Events are de-duplicated by UID and RECURRENCE-ID; when more
+// than one calendar has an event, the copy with the highest SEQUENCE wins,
+// and the one from the earliest calendar on ties.
+func mergeCalendars(cals []*ics.Calendar) *ics.Calendar {
+	merged := ics.NewCalendar()
+
+	var events []*ics.VEvent
+	byKey := make(map[string]int)
+	zones := make(map[string]bool)
+
+	for _, cal := range cals {
+		if cal == nil {
+			continue
+		}
+
+		for _, vtz := range cal.Timezones() {
+			tzid := vtz.GetProperty(ics.ComponentPropertyTzid)
+			if tzid == nil || zones[tzid.Value] {
+				continue
+			}
+
+			zones[tzid.Value] = true
+			merged.AddVTimezone(vtz)
+		}
+
+		for _, event := range cal.Events() {
+			key := event.Id()
+			if rid := event.GetProperty(ics.ComponentPropertyRecurrenceId); rid != nil {
+				key += "/" + rid.Value
+			}
+
+			i, ok := byKey[key]
+			if !ok || key == "" {
+				byKey[key] = len(events)
+				events = append(events, event)
+
+				continue
+			}
+
+			if sequence(event) > sequence(events[i]) {
+				events[i] = event
+			}
+		}
+	}
+
+	for _, event := range events {
+		merged.AddVEvent(event)
+	}
+
+	return merged
+}
+
+func sequence(event *ics.VEvent) int {
+	prop := event.GetProperty(ics.ComponentPropertySequence)
+	if prop == nil {
+		return 0
+	}
+
+	seq, _ := strconv.Atoi(strings.TrimSpace(prop.Value))
+
+	return seq
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const snapshotFile = "snapshot.json"
+
+// storedSnapshot is the last successfully fetched data of every calendar
+// source as written to the state directory, so hvor has something to serve
+// when the calendars cannot be fetched at startup.
+type storedSnapshot struct {
+	LastFetch time.Time                 `json:"lastFetch"`
+	Calendars map[string]storedCalendar `json:"calendars"`
+}
+
+// storedCalendar is the raw iCal data of a single source, keyed by the
+// source in storedSnapshot.
+type storedCalendar struct {
+	LastFetch time.Time `json:"lastFetch"`
+	Calendar  string    `json:"calendar"`
+}
+
+// saveSnapshot atomically replaces the snapshot in dir.
+func saveSnapshot(dir string, cals []sourceCalendar, lastFetch time.Time) error {
+	stored := storedSnapshot{
+		LastFetch: lastFetch,
+		Calendars: make(map[string]storedCalendar, len(cals)),
+	}
+
+	for _, sc := range cals {
+		if sc.raw == nil {
+			continue
+		}
+
+		stored.Calendars[sc.url] = storedCalendar{
+			LastFetch: sc.lastFetch,
+			Calendar:  string(sc.raw),
+		}
+	}
+
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, snapshotFile+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, snapshotFile)); err != nil {
+		return fmt.Errorf("failed to replace snapshot: %w", err)
+	}
+
+	return nil
+}
+
+func loadSnapshot(dir string) (*storedSnapshot, error) {
+	data, err := os.ReadFile(filepath.Join(dir, snapshotFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+
+	var stored storedSnapshot
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot: %w", err)
+	}
+
+	return &stored, nil
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/types/logger"
+)
+
+// person is someone a team instance shows the whereabouts of, at /<id>/.
+type person struct {
+	ID   string
+	Name string
+}
+
+// base returns the path the person is served under, empty for an instance
+// of one person.
+func (p person) base() string {
+	if p.ID == "" {
+		return ""
+	}
+
+	return "/" + p.ID
+}
+
+// allows reports whether a link for the person of id, everyone if empty,
+// opens the pages of p. The index of a team, with no person, only takes
+// links for everyone.
+func (p person) allows(id string) bool {
+	return id == "" || id == p.ID
+}
+
+// handler is what hvor registers its routes on, a kra server or a mux.
+type handler interface {
+	Handle(pattern string, handler http.Handler)
+}
+
+// handle registers the routes of h under the path of its person.
+func (h *hvor) handle(mux handler) {
+	base := h.config().person.base()
+
+	mux.Handle(base+"/readyz", h.readyzHandler())
+	mux.Handle(base+"/refresh", instrument("refresh", h.refreshHandler()))
+	mux.Handle(base+"/", instrument("index", h.handler()))
+	mux.Handle(base+"/events", instrument("events", h.eventsHandler()))
+	mux.Handle(base+"/future", instrument("future", h.future()))
+	mux.Handle(base+"/past", instrument("past", h.past()))
+	mux.Handle(base+"/api/v1/whereabouts", instrument("whereabouts", h.whereaboutsHandler()))
+	mux.Handle(base+"/ics", instrument("ics", h.icsHandler()))
+	mux.Handle(base+"/export/geojson", instrument("export_geojson", h.exportHandler("geojson")))
+	mux.Handle(base+"/export/kml", instrument("export_kml", h.exportHandler("kml")))
+	mux.Handle(base+"/export/gpx", instrument("export_gpx", h.exportHandler("gpx")))
+}
+
+// loadInitial fetches the calendars for the first time, falling back to
+// the persisted snapshot.
+func (h *hvor) loadInitial() error {
+	err := h.updateCalendar()
+	if err == nil {
+		return nil
+	}
+
+	if rerr := h.restoreSnapshot(); rerr != nil {
+		return fmt.Errorf("failed to get initial calendar: %w, and no snapshot to fall back to: %w", err, rerr)
+	}
+
+	h.logf("failed to get initial calendar, serving snapshot from %s: %s", h.snap.Load().lastFetch.Format(time.RFC3339), err)
+
+	return nil
+}
+
+// team serves several people from one instance: each at /<id>/ with the
+// routes of an instance of their own, and an index of them at /.
+type team struct {
+	// hvor holds the config and what is shared by everyone, like the
+	// token store and the audit log. It authorises the index with the
+	// team-wide tokens.
+	hvor *hvor
+
+	// syncMu serialises syncs, which fetch without holding mu.
+	syncMu sync.Mutex
+
+	mu      sync.RWMutex
+	members map[string]*member
+	order   []string
+
+	// mux serves the pages of the team itself.
+	mux *http.ServeMux
+}
+
+// member is a person of the team, with their own calendars.
+type member struct {
+	h      *hvor
+	mux    *http.ServeMux
+	cancel context.CancelFunc
+}
+
+func newTeam(h *hvor) *team {
+	t := &team{hvor: h, members: make(map[string]*member), mux: http.NewServeMux()}
+
+	t.mux.Handle("/{$}", instrument("team", t.index()))
+	t.mux.Handle("/overview", instrument("overview", t.overviewHandler()))
+	t.mux.Handle("/api/v1/overview", instrument("overview_api", t.overviewAPIHandler()))
+	t.mux.Handle("/audit", instrument("audit", h.auditHandler()))
+
+	return t
+}
+
+// newMember returns the instance of a person of the team, sharing
+// everything but the calendars with the team.
+func (t *team) newMember(cfg *config) *hvor {
+	h := &hvor{
+		tokenStore: t.hvor.tokenStore,
+		shareKey:   t.hvor.shareKey,
+		tsPolicy:   t.hvor.tsPolicy,
+		sessionKey: t.hvor.sessionSigningKey(),
+		audit:      t.hvor.audit,
+		webhooks:   t.hvor.webhooks,
+		tsLocal:    t.hvor.tsLocal,
+		refresh:    make(chan struct{}, 1),
+		logf:       logger.WithPrefix(t.hvor.logf, cfg.person.ID+": "),
+	}
+
+	// Sessions started at the index are valid for everyone.
+	h.sessionOnce.Do(func() {})
+
+	if t.hvor.stateDir != "" {
+		h.stateDir = filepath.Join(t.hvor.stateDir, cfg.person.ID)
+	}
+
+	h.conf.Store(cfg)
+
+	return h
+}
+
+// sync brings the members in line with the config: new people are added
+// and their calendars fetched, people no longer listed are removed, and
+// everyone else gets the new config and a refresh.
+func (t *team) sync(ctx context.Context) {
+	t.syncMu.Lock()
+	defer t.syncMu.Unlock()
+
+	cfg := t.hvor.config()
+
+	t.mu.RLock()
+	var added []*hvor
+
+	for _, pc := range cfg.People {
+		if _, ok := t.members[pc.ID]; !ok {
+			added = append(added, t.newMember(cfg.forPerson(pc)))
+		}
+	}
+	t.mu.RUnlock()
+
+	// New people are fetched before they are served, and concurrently so
+	// a slow calendar does not hold up the others.
+	var wg sync.WaitGroup
+
+	for _, h := range added {
+		wg.Go(func() {
+			if err := h.loadInitial(); err != nil {
+				h.logf("%s, serving no events until the next update", err)
+
+				if err := h.setCalendar(snapshot{stale: true}); err != nil {
+					h.logf("failed to build an empty calendar: %s", err)
+				}
+			}
+		})
+	}
+
+	wg.Wait()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, h := range added {
+		mux := http.NewServeMux()
+		h.handle(mux)
+
+		mctx, cancel := context.WithCancel(ctx)
+		go h.updater(mctx)
+
+		t.members[h.config().person.ID] = &member{h: h, mux: mux, cancel: cancel}
+	}
+
+	order := make([]string, 0, len(cfg.People))
+	listed := make(map[string]bool, len(cfg.People))
+
+	for _, pc := range cfg.People {
+		order = append(order, pc.ID)
+		listed[pc.ID] = true
+
+		if m := t.members[pc.ID]; !slices.Contains(added, m.h) {
+			m.h.conf.Store(cfg.forPerson(pc))
+			m.h.triggerRefresh()
+		}
+	}
+
+	for id, m := range t.members {
+		if !listed[id] {
+			m.cancel()
+			delete(t.members, id)
+		}
+	}
+
+	t.order = order
+}
+
+// people returns the members of the team, in the order of the config.
+func (t *team) people() []*hvor {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	ret := make([]*hvor, 0, len(t.order))
+	for _, id := range t.order {
+		ret = append(ret, t.members[id].h)
+	}
+
+	return ret
+}
+
+func (t *team) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	t.mu.RLock()
+	m := t.members[id]
+	t.mu.RUnlock()
+
+	if m == nil {
+		t.mux.ServeHTTP(w, r)
+
+		return
+	}
+
+	m.mux.ServeHTTP(w, r)
+}
+
+// index lists the people of the team.
+func (t *team) index() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := t.hvor.authorise(w, r, accessPage); !ok {
+			return
+		}
+
+		members := t.people()
+
+		people := make([]person, 0, len(members))
+		for _, h := range members {
+			people = append(people, h.config().person)
+		}
+
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(teamPage(people).Render()))
+	})
+}
+
+// readyzHandler reports whether the calendars of everyone are fresh, with
+// 503 if not. It is served to anyone, so the detail of readinessHandler is
+// only given with ?verbose to team-wide tokens of the full scope.
+func (t *team) readyzHandler() http.Handler {
+	detail := t.readinessHandler()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("verbose") {
+			if t.hvor.authoriseFull(w, r) {
+				detail.ServeHTTP(w, r)
+			}
+
+			return
+		}
+
+		ready, _ := t.readiness(time.Now())
+
+		writeReadiness(w, ready, struct {
+			Ready bool `json:"ready"`
+		}{ready})
+	})
+}
+
+// readinessHandler reports the readiness of everyone in detail, for the
+// debug handler and /readyz?verbose.
+func (t *team) readinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		ready, people := t.readiness(time.Now())
+
+		writeReadiness(w, ready, struct {
+			Ready  bool                 `json:"ready"`
+			People map[string]readiness `json:"people"`
+		}{ready, people})
+	})
+}
+
+// readiness returns whether everyone is ready, and the readiness of each.
+func (t *team) readiness(now time.Time) (bool, map[string]readiness) {
+	ready := true
+	people := make(map[string]readiness)
+
+	for _, h := range t.people() {
+		r := h.readiness(now)
+		ready = ready && r.Ready
+		people[h.config().person.ID] = r
+	}
+
+	return ready, people
+}
+
+// sourcesHandler reports the health of the calendar sources of everyone.
+func (t *team) sourcesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		ret := make(map[string][]sourceHealth)
+
+		for _, h := range t.people() {
+			if s := h.snap.Load(); s != nil {
+				ret[h.config().person.ID] = s.health()
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(ret)
+	})
+}
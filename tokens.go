@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/types/logger"
+)
+
+const tokenStorePoll = 10 * time.Second
+
+// storedToken is an access link in the token store file.
+type storedToken struct {
+	Token  string `json:"token"`
+	Label  string `json:"label"`
+	Scopes string `json:"scopes,omitempty"`
+
+	// Expires is when the link stops working for good.
+	Expires time.Time `json:"expires,omitzero"`
+
+	// ValidFrom and ValidUntil limit the link to a window, like the
+	// dates of a trip.
+	ValidFrom  time.Time `json:"validFrom,omitzero"`
+	ValidUntil time.Time `json:"validUntil,omitzero"`
+
+	Revoked bool `json:"revoked,omitempty"`
+
+	// Person limits the link to the person of that id in a team. Without
+	// it, the link is for everyone, like a team-wide token.
+	Person string `json:"person,omitempty"`
+
+	scope scope
+}
+
+// validAt reports whether the link can be used at now.
+func (st storedToken) validAt(now time.Time) bool {
+	switch {
+	case st.Revoked:
+		return false
+	case !st.Expires.IsZero() && !now.Before(st.Expires):
+		return false
+	case !st.ValidFrom.IsZero() && now.Before(st.ValidFrom):
+		return false
+	case !st.ValidUntil.IsZero() && !now.Before(st.ValidUntil):
+		return false
+	}
+
+	return true
+}
+
+type storedTokens struct {
+	modTime time.Time
+	size    int64
+	tokens  map[string]storedToken
+}
+
+// tokenStore holds the access links kept in a JSON file, reloaded when the
+// file changes so links can be added and revoked without a restart.
+type tokenStore struct {
+	path   string
+	logf   logger.Logf
+	loaded atomic.Pointer[storedTokens]
+}
+
+// newTokenStore loads the token store at path.
+func newTokenStore(path string, logf logger.Logf) (*tokenStore, error) {
+	ts := &tokenStore{path: path, logf: logf}
+	if err := ts.reload(); err != nil {
+		return nil, err
+	}
+
+	return ts, nil
+}
+
+// reload reads the token file if it changed since it was last loaded.
+// Entries with invalid scopes are skipped.
+func (ts *tokenStore) reload() error {
+	info, err := os.Stat(ts.path)
+	if err != nil {
+		return fmt.Errorf("failed to read token store: %w", err)
+	}
+
+	if prev := ts.loaded.Load(); prev != nil && prev.modTime.Equal(info.ModTime()) && prev.size == info.Size() {
+		return nil
+	}
+
+	data, err := os.ReadFile(ts.path)
+	if err != nil {
+		return fmt.Errorf("failed to read token store: %w", err)
+	}
+
+	var file struct {
+		Tokens []storedToken `json:"tokens"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to decode token store: %w", err)
+	}
+
+	next := storedTokens{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		tokens:  make(map[string]storedToken, len(file.Tokens)),
+	}
+
+	for _, st := range file.Tokens {
+		if st.Token == "" {
+			continue
+		}
+
+		st.scope = fullScope
+
+		if st.Scopes != "" {
+			sc, err := parseScope(st.Scopes)
+			if err != nil {
+				ts.logf("skipping token %q with invalid scope: %s", st.Label, err)
+
+				continue
+			}
+
+			st.scope = sc
+		}
+
+		next.tokens[st.Token] = st
+	}
+
+	ts.loaded.Store(&next)
+
+	return nil
+}
+
+// watch reloads the token file as it changes, until ctx is done. A file
+// that cannot be read keeps the tokens last loaded.
+func (ts *tokenStore) watch(ctx context.Context) {
+	ticker := time.NewTicker(tokenStorePoll)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := ts.reload(); err != nil {
+				ts.logf("failed to reload token store, keeping the loaded tokens: %s", err)
+			}
+		}
+	}
+}
+
+// lookup returns the link for token if it is valid at now.
+func (ts *tokenStore) lookup(token string, now time.Time) (storedToken, bool) {
+	loaded := ts.loaded.Load()
+	if loaded == nil || token == "" {
+		return storedToken{}, false
+	}
+
+	st, ok := loaded.tokens[token]
+	if !ok || !st.validAt(now) {
+		return storedToken{}, false
+	}
+
+	return st, true
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// tsIdentity is who a Tailscale peer is, as far as the policy is
+// concerned.
+type tsIdentity struct {
+	login string
+	tags  []string
+	// nodes holds the names the node is known by: its full MagicDNS
+	// name and its short one.
+	nodes []string
+	caps  map[string][]string
+}
+
+func newTSIdentity(who *apitype.WhoIsResponse) tsIdentity {
+	var id tsIdentity
+
+	if who.UserProfile != nil {
+		id.login = who.UserProfile.LoginName
+	}
+
+	if who.Node != nil {
+		id.tags = who.Node.Tags
+
+		if name := strings.TrimSuffix(who.Node.Name, "."); name != "" {
+			short, _, _ := strings.Cut(name, ".")
+			id.nodes = append(id.nodes, name, short)
+		}
+
+		if who.Node.ComputedName != "" {
+			id.nodes = append(id.nodes, who.Node.ComputedName)
+		}
+	}
+
+	id.caps = make(map[string][]string, len(who.CapMap))
+	for c, vals := range who.CapMap {
+		for _, v := range vals {
+			id.caps[string(c)] = append(id.caps[string(c)], string(v))
+		}
+	}
+
+	return id
+}
+
+// tailscaleLabel names a Tailscale peer for the audit log: by its login,
+// or by its node for tagged devices, which have no user.
+func tailscaleLabel(who *apitype.WhoIsResponse) string {
+	if who.Node != nil && (who.UserProfile == nil || len(who.Node.Tags) > 0) {
+		return "tailscale:" + who.Node.ComputedName
+	}
+
+	if who.UserProfile != nil {
+		return "tailscale:" + who.UserProfile.LoginName
+	}
+
+	return "tailscale"
+}
+
+// tsRule grants, or denies, Tailscale peers matching any of its logins,
+// tags, nodes or peer capabilities.
+type tsRule struct {
+	Logins       []string `json:"logins,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+	Nodes        []string `json:"nodes,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+
+	Deny   bool   `json:"deny,omitempty"`
+	Scopes string `json:"scopes,omitempty"`
+
+	scope scope
+}
+
+// capGrant is the value of a peer capability granted to hvor in the
+// tailnet policy, e.g. {"scopes": "city"}.
+type capGrant struct {
+	Scopes string `json:"scopes"`
+}
+
+// tsPolicy decides what Tailscale peers may see. The first rule matching
+// a peer applies; peers matching no rule get Default, or are denied if it
+// is empty.
+type tsPolicy struct {
+	Rules   []tsRule `json:"rules"`
+	Default string   `json:"default,omitempty"`
+
+	defaultScope *scope
+}
+
+// loadTSPolicy reads a Tailscale policy from a JSON file.
+func loadTSPolicy(path string) (*tsPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tailscale policy: %w", err)
+	}
+
+	var p tsPolicy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to decode tailscale policy: %w", err)
+	}
+
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+// validate checks the rules and parses their scopes.
+func (p *tsPolicy) validate() error {
+	for i := range p.Rules {
+		r := &p.Rules[i]
+
+		if len(r.Logins)+len(r.Tags)+len(r.Nodes)+len(r.Capabilities) == 0 {
+			return fmt.Errorf("tailscale policy rule %d matches nobody", i)
+		}
+
+		r.scope = fullScope
+
+		if r.Scopes != "" {
+			sc, err := parseScope(r.Scopes)
+			if err != nil {
+				return fmt.Errorf("tailscale policy rule %d: %w", i, err)
+			}
+
+			r.scope = sc
+		}
+	}
+
+	if p.Default != "" {
+		sc, err := parseScope(p.Default)
+		if err != nil {
+			return fmt.Errorf("tailscale policy default: %w", err)
+		}
+
+		p.defaultScope = &sc
+	}
+
+	return nil
+}
+
+// scope returns what the peer may see, if anything.
+func (p *tsPolicy) scope(id tsIdentity) (scope, bool) {
+	for _, r := range p.Rules {
+		sc, ok := r.match(id)
+		if !ok {
+			continue
+		}
+
+		if r.Deny {
+			return scope{}, false
+		}
+
+		return sc, true
+	}
+
+	if p.defaultScope != nil {
+		return *p.defaultScope, true
+	}
+
+	return scope{}, false
+}
+
+// match reports whether the rule applies to the peer, and with what scope.
+// A peer capability whose grant carries scopes uses those instead of the
+// rule's.
+func (r tsRule) match(id tsIdentity) (scope, bool) {
+	if id.login != "" && slices.Contains(r.Logins, id.login) {
+		return r.scope, true
+	}
+
+	for _, tag := range id.tags {
+		if slices.Contains(r.Tags, tag) {
+			return r.scope, true
+		}
+	}
+
+	for _, node := range id.nodes {
+		if slices.Contains(r.Nodes, node) {
+			return r.scope, true
+		}
+	}
+
+	for _, c := range r.Capabilities {
+		grants, ok := id.caps[c]
+		if !ok {
+			continue
+		}
+
+		return grantScope(grants, r.scope), true
+	}
+
+	return scope{}, false
+}
+
+// grantScope returns the widest scope of the capability grants, or fallback
+// if none of them carries scopes.
+func grantScope(grants []string, fallback scope) scope {
+	var ret *scope
+
+	for _, g := range grants {
+		var cg capGrant
+		if err := json.Unmarshal([]byte(g), &cg); err != nil || cg.Scopes == "" {
+			continue
+		}
+
+		sc, err := parseScope(cg.Scopes)
+		if err != nil {
+			continue
+		}
+
+		if ret == nil {
+			ret = &sc
+
+			continue
+		}
+
+		ret.precision = min(ret.precision, sc.precision)
+		ret.descriptions = ret.descriptions || sc.descriptions
+	}
+
+	if ret == nil {
+		return fallback
+	}
+
+	return *ret
+}
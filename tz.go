@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+const (
+	icalDateFormat     = "20060102"
+	icalDateTimeFormat = "20060102T150405"
+)
+
+var (
+	reUTCOffset = regexp.MustCompile(`^([+-])(\d{2})(\d{2})(\d{2})?$`)
+	reDuration  = regexp.MustCompile(`^([+-])?P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+)
+
+// timezones resolves TZID parameters to locations. Identifiers known to
+// the Go time zone database are used as is, the rest are looked up in the
+// VTIMEZONE definitions of the calendar.
+type timezones map[string]*time.Location
+
+func calendarTimezones(cal *ics.Calendar) timezones {
+	tzs := make(timezones)
+
+	for _, vtz := range cal.Timezones() {
+		prop := vtz.GetProperty(ics.ComponentPropertyTzid)
+		if prop == nil {
+			continue
+		}
+
+		if loc := vtimezoneLocation(vtz, prop.Value); loc != nil {
+			tzs[prop.Value] = loc
+		}
+	}
+
+	return tzs
+}
+
+// vtimezoneLocation turns a VTIMEZONE into a location. Producers like
+// Outlook use identifiers such as "W. Europe Standard Time", which are
+// resolved through X-LIC-LOCATION when present, and otherwise approximated
+// by the offset of the STANDARD observance.
+func vtimezoneLocation(vtz *ics.VTimezone, tzid string) *time.Location {
+	if loc, err := loadLocation(tzid); err == nil {
+		return loc
+	}
+
+	if lic := vtz.GetProperty(ics.ComponentProperty("X-LIC-LOCATION")); lic != nil {
+		if loc, err := loadLocation(lic.Value); err == nil {
+			return loc
+		}
+	}
+
+	for _, comp := range vtz.Components {
+		std, ok := comp.(*ics.Standard)
+		if !ok {
+			continue
+		}
+
+		offset := std.GetProperty(ics.ComponentProperty(ics.PropertyTzoffsetto))
+		if offset == nil {
+			continue
+		}
+
+		if secs, err := parseUTCOffset(offset.Value); err == nil {
+			return time.FixedZone(tzid, secs)
+		}
+	}
+
+	return nil
+}
+
+// loadLocation loads an Olson zone name, also accepting the prefixed forms
+// some producers emit, like "/Europe/Oslo" or
+// "/mozilla.org/20050126_1/Europe/Oslo".
+func loadLocation(name string) (*time.Location, error) {
+	name = strings.Trim(name, `"`)
+
+	loc, err := time.LoadLocation(name)
+	if err == nil {
+		return loc, nil
+	}
+
+	parts := strings.Split(strings.Trim(name, "/"), "/")
+	for i := 1; i < len(parts); i++ {
+		if loc, err := time.LoadLocation(strings.Join(parts[i:], "/")); err == nil {
+			return loc, nil
+		}
+	}
+
+	return nil, err
+}
+
+func (tzs timezones) location(tzid string) (*time.Location, error) {
+	if loc, ok := tzs[tzid]; ok {
+		return loc, nil
+	}
+
+	loc, err := loadLocation(tzid)
+	if err != nil {
+		return nil, fmt.Errorf("unknown TZID %q", tzid)
+	}
+
+	return loc, nil
+}
+
+// parse parses a DATE or DATE-TIME value. DATE values are returned as
+// midnight local time and reported as all-day. DATE-TIME values are
+// returned in the zone given by their TZID, in UTC for the "Z" form, and
+// in local time when floating.
+func (tzs timezones) parse(value string, params map[string][]string) (time.Time, bool, error) {
+	value = strings.TrimSpace(value)
+
+	if len(value) == len(icalDateFormat) || slices.Contains(params[string(ics.ParameterValue)], string(ics.ValueDataTypeDate)) {
+		if len(value) < len(icalDateFormat) {
+			return time.Time{}, false, fmt.Errorf("invalid date %q", value)
+		}
+
+		t, err := time.ParseInLocation(icalDateFormat, value[:len(icalDateFormat)], time.Local)
+
+		return t, true, err
+	}
+
+	if utc, ok := strings.CutSuffix(value, "Z"); ok {
+		t, err := time.ParseInLocation(icalDateTimeFormat, utc, time.UTC)
+
+		return t, false, err
+	}
+
+	loc := time.Local
+
+	if tzid, ok := params[string(ics.ParameterTzid)]; ok && len(tzid) > 0 {
+		var err error
+
+		loc, err = tzs.location(tzid[0])
+		if err != nil {
+			return time.Time{}, false, err
+		}
+	}
+
+	t, err := time.ParseInLocation(icalDateTimeFormat, value, loc)
+
+	return t, false, err
+}
+
+// parseProperty parses every value of a date property, which may be a
+// comma separated list as in RDATE and EXDATE. PERIOD values contribute
+// their start.
+func (tzs timezones) parseProperty(prop *ics.IANAProperty) ([]time.Time, error) {
+	var ret []time.Time
+
+	for _, v := range strings.Split(prop.Value, ",") {
+		start, _, _ := strings.Cut(v, "/")
+		if strings.TrimSpace(start) == "" {
+			continue
+		}
+
+		t, _, err := tzs.parse(start, prop.ICalParameters)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s value %q: %w", prop.IANAToken, v, err)
+		}
+
+		ret = append(ret, t)
+	}
+
+	return ret, nil
+}
+
+// parseUTCOffset parses a UTC offset like "+0100" or "-023000" into
+// seconds east of UTC.
+func parseUTCOffset(s string) (int, error) {
+	m := reUTCOffset.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0, fmt.Errorf("invalid UTC offset %q", s)
+	}
+
+	hours, _ := strconv.Atoi(m[2])
+	minutes, _ := strconv.Atoi(m[3])
+	seconds, _ := strconv.Atoi(m[4])
+
+	secs := hours*3600 + minutes*60 + seconds
+	if m[1] == "-" {
+		secs = -secs
+	}
+
+	return secs, nil
+}
+
+// parseDuration parses a DURATION value into its nominal days, which
+// follow wall clock time across DST changes, and the exact remainder.
+func parseDuration(s string) (int, time.Duration, error) {
+	m := reDuration.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil || s == "P" || strings.HasSuffix(s, "T") {
+		return 0, 0, fmt.Errorf("invalid duration %q", s)
+	}
+
+	num := func(i int) int {
+		n, _ := strconv.Atoi(m[i])
+
+		return n
+	}
+
+	days := num(2)*7 + num(3)
+	d := time.Duration(num(4))*time.Hour +
+		time.Duration(num(5))*time.Minute +
+		time.Duration(num(6))*time.Second
+
+	if m[1] == "-" {
+		return -days, -d, nil
+	}
+
+	return days, d, nil
+}
@@ -4,6 +4,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/chasefleming/elem-go"
 )
@@ -99,6 +100,14 @@ func getEnvInt(key string, fallback int) int {
 	return fallback
 }
 
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	if val, err := time.ParseDuration(getEnv(key, "")); err == nil {
+		return val
+	}
+
+	return fallback
+}
+
 func renderNodeList(nodes []elem.Node) string {
 	var sb strings.Builder
 
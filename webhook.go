@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/types/logger"
+)
+
+const (
+	// webhookAttempts is how often a webhook is tried before the change is
+	// given up on.
+	webhookAttempts = 4
+
+	// maxWebhookQueue is how many changes may wait for a webhook.
+	maxWebhookQueue = 100
+)
+
+// webhookRetry is how long to wait before retrying a webhook, doubling
+// with every attempt. It is a variable so tests do not have to wait.
+var webhookRetry = 5 * time.Second
+
+// changeKind is what happened to the whereabouts between two updates.
+type changeKind string
+
+const (
+	changeArrived   changeKind = "arrived"
+	changeAdded     changeKind = "added"
+	changeCancelled changeKind = "cancelled"
+	changeMoved     changeKind = "moved"
+
+	// changeColocation is people found in the same place at the same
+	// time, or near a watched place.
+	changeColocation changeKind = "colocation"
+)
+
+var changeKinds = []changeKind{changeArrived, changeAdded, changeCancelled, changeMoved, changeColocation}
+
+// webhookConfig is a URL told about changes to the whereabouts:
+//
+//	"webhooks": [
+//	  {"url": "https://ntfy.sh/where-is-kristoffer", "format": "ntfy", "events": ["arrived"]},
+//	  {"url": "https://hooks.slack.com/services/…", "format": "slack", "scopes": "city"},
+//	],
+//
+// The format is "json" by default, posting the change with the event as in
+// the API. "ntfy" posts plain text with a title, and "slack" a message
+// Slack and Matrix hookshot understand. Events are the kinds of change
+// told, "arrived", "added", "cancelled", "moved" and "colocation", all by
+// default, and scopes restrict what is told as they do for tokens.
+type webhookConfig struct {
+	URL    string       `json:"url"`
+	Format string       `json:"format"`
+	Events []changeKind `json:"events"`
+	Scopes string       `json:"scopes"`
+
+	scope scope
+}
+
+func (wc *webhookConfig) validate(field string) []error {
+	var errs []error
+
+	if !strings.HasPrefix(wc.URL, "http://") && !strings.HasPrefix(wc.URL, "https://") {
+		errs = append(errs, fmt.Errorf("%s.url: must be an http(s) URL", field))
+	}
+
+	switch wc.Format {
+	case "", "json", "ntfy", "slack":
+	default:
+		errs = append(errs, fmt.Errorf("%s.format: unsupported format %q, use \"json\", \"ntfy\" or \"slack\"", field, wc.Format))
+	}
+
+	for _, k := range wc.Events {
+		if !slices.Contains(changeKinds, k) {
+			errs = append(errs, fmt.Errorf("%s.events: unknown event %q", field, k))
+		}
+	}
+
+	wc.scope = fullScope
+
+	if wc.Scopes != "" {
+		sc, err := parseScope(wc.Scopes)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s.scopes: %w", field, err))
+		}
+
+		wc.scope = sc
+	}
+
+	return errs
+}
+
+// wants reports whether the webhook is told about changes of kind k.
+func (wc webhookConfig) wants(k changeKind) bool {
+	return len(wc.Events) == 0 || slices.Contains(wc.Events, k)
+}
+
+// change is something that happened to the whereabouts between two
+// updates. Previous is what the event was before it moved, or where the
+// person was before they arrived. A co-location has no event, but the
+// names of the people in it.
+type change struct {
+	kind     changeKind
+	event    pageEvent
+	previous *pageEvent
+
+	colocation *colocation
+	names      map[string]string
+}
+
+// eventKey identifies an event, and the instance of a recurring one.
+type eventKey struct {
+	uid  string
+	from int64
+}
+
+func newEventKey(pe pageEvent) eventKey {
+	return eventKey{uid: cmp.Or(pe.UID, pe.Summary), from: pe.From.Unix()}
+}
+
+// allEvents returns every event of p.
+func allEvents(p *page) pageEvents {
+	var ret pageEvents
+	if p.Current != nil {
+		ret = append(ret, *p.Current)
+	}
+
+	ret = append(ret, p.Concurrent...)
+	ret = append(ret, p.Past...)
+	ret = append(ret, p.Future...)
+
+	return ret
+}
+
+// diffPages returns what changed from prev to next, at now. Events are
+// matched by UID and start, and else by UID alone if that is unambiguous,
+// so a moved trip is not told as cancelled and added again. Only events
+// that have not ended are told about, and no events starting after
+// horizon, the end of the window of prev, as they only came into view.
+func diffPages(prev, next *page, now, horizon time.Time) []change {
+	var ret []change
+
+	if cur := next.Current; cur != nil && cur.Location != nil && (prev.Current == nil || !sameLocation(prev.Current.Location, cur.Location)) {
+		ret = append(ret, change{kind: changeArrived, event: *cur, previous: prev.Current})
+	}
+
+	before, after := allEvents(prev), allEvents(next)
+	matchedBefore := make([]bool, len(before))
+	matchedAfter := make([]bool, len(after))
+
+	var pairs [][2]int
+
+	byKey := make(map[eventKey]int, len(after))
+	for j, pe := range after {
+		byKey[newEventKey(pe)] = j
+	}
+
+	for i, pe := range before {
+		if j, ok := byKey[newEventKey(pe)]; ok && !matchedAfter[j] {
+			pairs = append(pairs, [2]int{i, j})
+			matchedBefore[i], matchedAfter[j] = true, true
+		}
+	}
+
+	unmatched := func(es pageEvents, matched []bool) map[string][]int {
+		ret := make(map[string][]int)
+
+		for i, pe := range es {
+			if !matched[i] {
+				uid := newEventKey(pe).uid
+				ret[uid] = append(ret[uid], i)
+			}
+		}
+
+		return ret
+	}
+
+	restAfter := unmatched(after, matchedAfter)
+	for uid, is := range unmatched(before, matchedBefore) {
+		if js := restAfter[uid]; len(is) == 1 && len(js) == 1 {
+			pairs = append(pairs, [2]int{is[0], js[0]})
+			matchedBefore[is[0]], matchedAfter[js[0]] = true, true
+		}
+	}
+
+	var changes []change
+
+	for _, pair := range pairs {
+		a, b := before[pair[0]], after[pair[1]]
+		if (a.To.After(now) || b.To.After(now)) && eventMoved(a, b) {
+			changes = append(changes, change{kind: changeMoved, event: b, previous: &a})
+		}
+	}
+
+	for i, pe := range before {
+		if !matchedBefore[i] && pe.To.After(now) {
+			changes = append(changes, change{kind: changeCancelled, event: pe})
+		}
+	}
+
+	for j, pe := range after {
+		if !matchedAfter[j] && pe.To.After(now) && pe.From.Before(horizon) {
+			changes = append(changes, change{kind: changeAdded, event: pe})
+		}
+	}
+
+	slices.SortStableFunc(changes, func(x, y change) int {
+		return x.event.From.Compare(y.event.From)
+	})
+
+	return append(ret, changes...)
+}
+
+// eventMoved reports whether an event changed its time or place.
+func eventMoved(a, b pageEvent) bool {
+	return !a.From.Equal(b.From) || !a.To.Equal(b.To) || a.Summary != b.Summary || !sameLocation(a.Location, b.Location)
+}
+
+func sameLocation(a, b *appleLocation) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return a.Title == b.Title && a.Latitude == b.Latitude && a.Longitude == b.Longitude
+}
+
+// place returns where an event is, for messages.
+func place(pe pageEvent) string {
+	if pe.Location != nil && pe.Location.Title != "" {
+		return pe.Location.Title
+	}
+
+	return pe.Summary
+}
+
+// title, details and message describe c, done by who, for the formats
+// read by people.
+func (c change) title(who string) string {
+	var title string
+
+	switch c.kind {
+	case changeArrived:
+		title = "Arrived"
+	case changeAdded:
+		title = "New trip"
+	case changeCancelled:
+		title = "Trip cancelled"
+	case changeMoved:
+		title = "Trip moved"
+	case changeColocation:
+		title = "Co-location"
+	}
+
+	if who == "" {
+		return title
+	}
+
+	return who + ": " + title
+}
+
+func (c change) details() string {
+	when := func(pe pageEvent) string {
+		return formatEventTime(pe, pe.From) + " to " + formatEventTime(pe, pe.To)
+	}
+
+	switch c.kind {
+	case changeColocation:
+		return colocationMessage(*c.colocation, c.names)
+	case changeArrived:
+		return place(c.event) + ", until " + formatEventTime(c.event, c.event.To)
+	case changeMoved:
+		return place(*c.previous) + ", " + when(*c.previous) + ", now " + place(c.event) + ", " + when(c.event)
+	}
+
+	return place(c.event) + ", " + when(c.event)
+}
+
+func (c change) message(who string) string {
+	return c.title(who) + ": " + c.details()
+}
+
+// webhookPayload is a change as posted in the json format.
+type webhookPayload struct {
+	Type       changeKind  `json:"type"`
+	Person     string      `json:"person,omitempty"`
+	Name       string      `json:"name,omitempty"`
+	Message    string      `json:"message"`
+	Event      *apiEvent   `json:"event,omitempty"`
+	Previous   *apiEvent   `json:"previous,omitempty"`
+	Colocation *colocation `json:"colocation,omitempty"`
+}
+
+// body returns the request body of c in the format of the webhook, and
+// its content type.
+func (wc webhookConfig) body(who person, c change) ([]byte, string, error) {
+	msg := c.message(who.Name)
+
+	var v any
+
+	switch wc.Format {
+	case "ntfy":
+		// The title goes in a header.
+		return []byte(c.details()), "text/plain; charset=utf-8", nil
+	case "slack":
+		v = map[string]string{"text": msg}
+	default:
+		payload := webhookPayload{
+			Type:       c.kind,
+			Person:     who.ID,
+			Name:       who.Name,
+			Message:    msg,
+			Colocation: c.colocation,
+		}
+
+		if c.kind != changeColocation {
+			ev := newAPIEvent(c.event)
+			payload.Event = &ev
+		}
+
+		if c.previous != nil {
+			prev := newAPIEvent(*c.previous)
+			payload.Previous = &prev
+		}
+
+		v = payload
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to encode webhook: %w", err)
+	}
+
+	return data, "application/json", nil
+}
+
+// post sends c to the webhook once.
+func (wc webhookConfig) post(ctx context.Context, who person, c change) error {
+	data, contentType, err := wc.body(who, c)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wc.URL, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook: %w", err)
+	}
+
+	req.Header.Set("Content-Type", contentType)
+
+	if wc.Format == "ntfy" {
+		req.Header.Set("Title", c.title(who.Name))
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send webhook: %w", err)
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return statusError{op: "webhook", code: resp.StatusCode}
+	}
+
+	return nil
+}
+
+// deliver posts c to the webhook, retrying with backoff before giving up
+// on it.
+func (wc webhookConfig) deliver(ctx context.Context, who person, c change, logf logger.Logf) {
+	wait := webhookRetry
+
+	for attempt := 1; ; attempt++ {
+		err := wc.post(ctx, who, c)
+		if err == nil {
+			webhookDeliveries.WithLabelValues(cmp.Or(wc.Format, "json"), "ok").Inc()
+
+			return
+		}
+
+		if attempt == webhookAttempts || ctx.Err() != nil {
+			webhookDeliveries.WithLabelValues(cmp.Or(wc.Format, "json"), "failed").Inc()
+			logf("failed to deliver %s webhook to %s, giving up: %s", c.kind, redactSource(wc.URL), err)
+
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(wait):
+		}
+
+		wait *= 2
+	}
+}
+
+// delivery is a change waiting to be posted to a webhook.
+type delivery struct {
+	wc     webhookConfig
+	who    person
+	change change
+}
+
+// webhookQueue delivers changes to every webhook in the order they were
+// queued, one at a time per webhook, until ctx is done. It is shared by
+// everyone in a team, so a webhook hears of everyone in order too.
+type webhookQueue struct {
+	ctx  context.Context
+	logf logger.Logf
+
+	// pending are the deliveries waiting by webhook URL. A URL is listed
+	// while its worker runs, which stops when there is nothing left.
+	mu      sync.Mutex
+	pending map[string][]delivery
+}
+
+func newWebhookQueue(ctx context.Context, logf logger.Logf) *webhookQueue {
+	return &webhookQueue{ctx: ctx, logf: logf, pending: make(map[string][]delivery)}
+}
+
+// enqueue queues the changes for wc, dropping the oldest if too many are
+// waiting for a webhook that is down.
+func (q *webhookQueue) enqueue(wc webhookConfig, who person, changes []change) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	pending, running := q.pending[wc.URL]
+
+	for _, c := range changes {
+		pending = append(pending, delivery{wc: wc, who: who, change: c})
+	}
+
+	if dropped := len(pending) - maxWebhookQueue; dropped > 0 {
+		q.logf("too many changes waiting for %s, dropping the %d oldest", redactSource(wc.URL), dropped)
+		pending = pending[dropped:]
+	}
+
+	q.pending[wc.URL] = pending
+
+	if !running {
+		go q.run(wc.URL)
+	}
+}
+
+// run delivers the changes queued for a webhook URL until there are none.
+func (q *webhookQueue) run(u string) {
+	for {
+		q.mu.Lock()
+
+		pending := q.pending[u]
+		if len(pending) == 0 || q.ctx.Err() != nil {
+			delete(q.pending, u)
+			q.mu.Unlock()
+
+			return
+		}
+
+		next := pending[0]
+		q.pending[u] = pending[1:]
+		q.mu.Unlock()
+
+		next.wc.deliver(q.ctx, next.who, next.change, q.logf)
+	}
+}
+
+// notifyChanges tells the webhooks what changed from the page of prev to
+// the page of next. Nothing is told if prev had no calendars yet or was
+// built for another window, as everything would look new.
+func (h *hvor) notifyChanges(prev, next *snapshot) {
+	cfg := h.config()
+	if h.webhooks == nil || len(cfg.Webhooks) == 0 || prev == nil || prev.calPage == nil || prev.window != next.window || !prev.fetched() {
+		return
+	}
+
+	_, horizon := prev.window.bounds(prev.built)
+
+	for _, wc := range cfg.Webhooks {
+		var changes []change
+
+		for _, c := range diffPages(prev.calPage.restrict(wc.scope), next.calPage.restrict(wc.scope), next.built, horizon) {
+			if wc.wants(c.kind) {
+				changes = append(changes, c)
+			}
+		}
+
+		if len(changes) > 0 {
+			h.webhooks.enqueue(wc, cfg.person, changes)
+		}
+	}
+}
+
+// fetched reports whether any calendar of s has been fetched.
+func (s *snapshot) fetched() bool {
+	for _, sc := range s.calendars {
+		if sc.cal != nil {
+			return true
+		}
+	}
+
+	return false
+}